@@ -0,0 +1,67 @@
+package stacktracetograph
+
+import "container/list"
+
+// reportedCache remembers the keys of reported stacks and how often each
+// was reported. When its capacity is positive, the least recently reported
+// keys are evicted beyond it.
+type reportedCache struct {
+	capacity int
+	order    *list.List // most recently used first
+	entries  map[string]*list.Element
+}
+
+// cacheEntry is a reported stack.
+type cacheEntry struct {
+	key   string
+	stack []ParsedStackEntry
+	hits  int64
+}
+
+func newReportedCache(capacity int) *reportedCache {
+	return &reportedCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// contains reports whether key was reported, counting a hit and marking it
+// as recently used.
+func (c *reportedCache) contains(key string) bool {
+	e, ok := c.entries[key]
+	if ok {
+		e.Value.(*cacheEntry).hits++
+		c.order.MoveToFront(e)
+	}
+	return ok
+}
+
+// add records the stack reported for key, evicting the least recently used
+// key if the cache is full.
+func (c *reportedCache) add(key string, stack []ParsedStackEntry) {
+	if e, ok := c.entries[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, stack: stack, hits: 1})
+	if c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *reportedCache) len() int {
+	return c.order.Len()
+}
+
+// counts returns the reported stacks with their hits, most recent first.
+func (c *reportedCache) counts() []StackCount {
+	counts := make([]StackCount, 0, c.order.Len())
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		entry := e.Value.(*cacheEntry)
+		counts = append(counts, StackCount{Stack: entry.stack, Count: entry.hits})
+	}
+	return counts
+}
@@ -0,0 +1,120 @@
+package stacktracetograph
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// traceEvent is an event of the Chrome Trace Event format, read by Perfetto
+// and chrome://tracing.
+type traceEvent struct {
+	Name  string         `json:"name"`
+	Cat   string         `json:"cat,omitempty"`
+	Ph    string         `json:"ph"`
+	Ts    float64        `json:"ts"` // microseconds
+	Dur   float64        `json:"dur,omitempty"`
+	Pid   int            `json:"pid"`
+	Tid   int64          `json:"tid"`
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes reports as Chrome trace event JSON, viewable in
+// Perfetto or chrome://tracing. Each goroutine is a track, reports with a
+// Duration are slices ending when the report was made and the others are
+// instant events. Reports without a Time are skipped.
+func WriteChromeTrace(w io.Writer, reports []Report) error {
+	var events []traceEvent
+	goroutines := make(map[int64]bool)
+	for _, report := range reports {
+		if report.Time.IsZero() {
+			continue
+		}
+		event := traceEvent{
+			Name: reportEventName(report),
+			Cat:  "stack",
+			Ph:   "i",
+			Ts:   float64(report.Time.UnixNano()) / 1e3,
+			Pid:  1,
+			Tid:  report.Goroutine,
+			Args: reportEventArgs(report),
+		}
+		if len(report.Attachments) > 0 {
+			event.Cat = report.Attachments[0].Label
+		}
+		if report.Duration > 0 {
+			event.Ph = "X"
+			event.Dur = float64(report.Duration.Nanoseconds()) / 1e3
+			event.Ts -= event.Dur
+		} else {
+			event.Scope = "t"
+		}
+		events = append(events, event)
+		goroutines[report.Goroutine] = true
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Ts < events[j].Ts })
+
+	// Name the tracks after the goroutines
+	ids := make([]int64, 0, len(goroutines))
+	for id := range goroutines {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	metadata := []traceEvent{{Name: "process_name", Ph: "M", Pid: 1, Args: map[string]any{"name": "stack2graph"}}}
+	for _, id := range ids {
+		name := fmt.Sprintf("goroutine %d", id)
+		if id == 0 {
+			name = "unknown goroutine"
+		}
+		metadata = append(metadata, traceEvent{Name: "thread_name", Ph: "M", Pid: 1, Tid: id, Args: map[string]any{"name": name}})
+	}
+
+	return json.NewEncoder(w).Encode(map[string]any{
+		"traceEvents":     append(metadata, events...),
+		"displayTimeUnit": "ms",
+	})
+}
+
+// reportEventName names the event of a report after the function it
+// originates from, prefixed with the label of its first attachment.
+func reportEventName(report Report) string {
+	frame := originFrame(report.Stack)
+	if len(report.Attachments) > 0 {
+		frame = report.Attachments[0].Frame
+	}
+	if frame < 0 || frame >= len(report.Stack) {
+		frame = 0
+	}
+
+	name := "stack"
+	if len(report.Stack) > 0 {
+		name = FoldedOptions{}.frameName(report.Stack[frame])
+	}
+	if len(report.Attachments) > 0 {
+		name = report.Attachments[0].Label + " in " + name
+	}
+	return name
+}
+
+// reportEventArgs returns the stack and attachments of a report, shown when
+// its event is selected.
+func reportEventArgs(report Report) map[string]any {
+	stack := make([]string, len(report.Stack))
+	for i, frame := range report.Stack {
+		stack[i] = fmt.Sprintf("%s %s:%s", frameSymbol(frame), frame.File, frame.Line)
+	}
+	args := map[string]any{"stack": stack}
+	for _, a := range report.Attachments {
+		props := make(map[string]any, len(a.Key)+len(a.Properties))
+		for k, v := range a.Key {
+			props[k] = v
+		}
+		for k, v := range a.Properties {
+			props[k] = v
+		}
+		args[a.Label] = props
+	}
+	return args
+}
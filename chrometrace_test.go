@@ -0,0 +1,133 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestWriteChromeTrace(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s, err := New(WithSink(sink), WithDeduplication(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		s.ReportStacktrace()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ReportStacktrace()
+	}()
+	<-done
+
+	reports := sink.Reports()
+	if len(reports) != 3 {
+		t.Fatalf("sink received %d reports; want 3 without deduplication", len(reports))
+	}
+	if reports[0].Goroutine == 0 || reports[0].Goroutine == reports[2].Goroutine || reports[0].Time.IsZero() {
+		t.Fatalf("reports do not carry their time and goroutine: %+v", reports)
+	}
+
+	query := Attachment{Label: "Query", Key: map[string]interface{}{"sql": "SELECT 1"}}
+	for i, frame := range reports[0].Stack {
+		if frame.Function == "TestWriteChromeTrace" {
+			query.Frame = i
+		}
+	}
+	measured := Report{
+		Stack:       reports[0].Stack,
+		Attachments: []Attachment{query},
+		Time:        reports[0].Time,
+		Goroutine:   reports[0].Goroutine,
+		Duration:    2 * time.Millisecond,
+	}
+
+	var buf bytes.Buffer
+	if err := WriteChromeTrace(&buf, append(reports, measured, Report{})); err != nil {
+		t.Fatalf("WriteChromeTrace() = %v", err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, buf.String())
+	}
+
+	var tracks, instants, slices int
+	var last float64
+	for _, event := range trace.TraceEvents {
+		switch event.Ph {
+		case "M":
+			if event.Name == "thread_name" {
+				tracks++
+			}
+		case "i":
+			instants++
+			if stack, _ := event.Args["stack"].([]any); len(stack) == 0 {
+				t.Errorf("instant event %+v has no stack", event)
+			}
+		case "X":
+			slices++
+			if event.Name != "Query in TestWriteChromeTrace" || event.Dur != 2000 || event.Cat != "Query" {
+				t.Errorf("slice event = %+v", event)
+			}
+		}
+		if event.Ph != "M" {
+			if event.Ts < last {
+				t.Errorf("events are not ordered by time")
+			}
+			last = event.Ts
+		}
+	}
+	if tracks != 2 || instants != 3 || slices != 1 {
+		t.Errorf("trace has %d tracks, %d instant and %d slice events; want 2, 3 and 1", tracks, instants, slices)
+	}
+}
+
+func TestStartSpan(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	end := s.StartSpan(context.Background())
+	time.Sleep(2 * time.Millisecond)
+	if err := end(); err != nil {
+		t.Fatalf("span end = %v", err)
+	}
+
+	reports := sink.Reports()
+	if len(reports) != 1 || reports[0].Duration < 2*time.Millisecond {
+		t.Fatalf("sink received %+v; want one report lasting the span", reports)
+	}
+	var buf bytes.Buffer
+	if err := WriteChromeTrace(&buf, reports); err != nil {
+		t.Fatal(err)
+	}
+	var trace struct {
+		TraceEvents []traceEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &trace); err != nil {
+		t.Fatal(err)
+	}
+	last := trace.TraceEvents[len(trace.TraceEvents)-1]
+	if last.Ph != "X" || last.Dur < 2000 {
+		t.Errorf("span event = %+v; want a slice of at least 2ms", last)
+	}
+}
+
+func TestTraceGoroutineID(t *testing.T) {
+	if id := traceGoroutineID(goroutineDump); id != 1 {
+		t.Errorf("traceGoroutineID() = %d; want 1", id)
+	}
+	if id := traceGoroutineID("main.main(...)\n\t/app/main.go:12\n"); id != 0 {
+		t.Errorf("traceGoroutineID() without header = %d; want 0", id)
+	}
+}
@@ -0,0 +1,251 @@
+package stacktracetograph
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CypherSink writes reports as a Cypher script, for environments that
+// cannot reach Neo4j. The statements merging the nodes and relationships of
+// every report are written as it arrives, after the constraints of the
+// schema, so the script holds every report written before a crash. It is
+// imported later with cypher-shell:
+//
+//	cypher-shell -u neo4j -p password -f stacks.cypher
+type CypherSink struct {
+	graph *Graph // totals of the weights, set by the statements
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	file    *os.File
+	path    string // renamed from file on Close
+	started bool
+}
+
+// NewCypherSink returns a sink writing the script to w.
+func NewCypherSink(w io.Writer) *CypherSink {
+	return &CypherSink{graph: NewGraph(), w: bufio.NewWriter(w)}
+}
+
+// NewCypherFileSink returns a sink writing the script to a temporary file
+// in the directory of path, renamed to path when the sink is closed. An
+// existing file at path is left untouched until then, and after a crash the
+// temporary file holds the reports written so far.
+func NewCypherFileSink(path string) (*CypherSink, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Cypher file: %w", err)
+	}
+	return &CypherSink{graph: NewGraph(), w: bufio.NewWriter(f), file: f, path: path}, nil
+}
+
+// Write writes the statements merging the nodes and relationships of the
+// report, with the totals of their weights. Reports written after Close are
+// ignored.
+func (c *CypherSink) Write(ctx context.Context, report Report) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	c.start()
+
+	if !c.graph.add(report) {
+		return nil
+	}
+	written := NewGraph()
+	written.Add(report)
+
+	g := c.graph
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.index()
+	for _, node := range written.Nodes {
+		writeCypherNode(c.w, g.Nodes[g.nodes[node.ID]])
+	}
+	for _, rel := range written.Relationships {
+		writeCypherRelationship(c.w, g, g.Relationships[g.relationships[relationshipKey(rel.From, rel.Type, rel.To)]])
+	}
+	if err := c.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write Cypher script: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the script and renames its file to the path of the sink.
+func (c *CypherSink) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.w == nil {
+		return nil
+	}
+	c.start()
+	err := c.w.Flush()
+	if c.file != nil {
+		err = errors.Join(err, c.file.Close())
+		if err == nil {
+			err = os.Rename(c.file.Name(), c.path)
+		}
+	}
+	c.w, c.file = nil, nil
+	return err
+}
+
+// start writes the header of the script once.
+func (c *CypherSink) start() {
+	if !c.started {
+		writeCypherSchema(c.w)
+		c.started = true
+	}
+}
+
+// WriteCypher writes the graph as a Cypher script of MERGE statements, one
+// per line, after the constraints and indexes of the schema. Nodes are
+// merged on the same properties as by Neo4jSink, and weights are set rather
+// than added, so running the script again leaves the database unchanged;
+// weights written to the same relationships by other means are overwritten.
+func WriteCypher(w io.Writer, g *Graph) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.index()
+
+	bw := bufio.NewWriter(w)
+	writeCypherSchema(bw)
+	for _, node := range g.Nodes {
+		writeCypherNode(bw, node)
+	}
+	for _, rel := range g.Relationships {
+		writeCypherRelationship(bw, g, rel)
+	}
+	return bw.Flush()
+}
+
+// writeCypherSchema writes the statements of the schema migrations, and
+// records them like SetupSchema.
+func writeCypherSchema(w *bufio.Writer) {
+	fmt.Fprintf(w, "// stack2graph schema version %d\n", schemaMigrations[len(schemaMigrations)-1].version)
+	for _, m := range schemaMigrations {
+		for _, statement := range m.statements {
+			fmt.Fprintf(w, "%s;\n", statement)
+		}
+		fmt.Fprintf(w, "MERGE (m:%s {version: %d}) ON CREATE SET m.description = %s, m.appliedAt = datetime();\n",
+			schemaMigrationLabel, m.version, cypherLiteral(m.description))
+	}
+}
+
+func writeCypherNode(w *bufio.Writer, node GraphNode) {
+	fmt.Fprintf(w, "MERGE %s", nodePattern("n", node))
+	var sets []string
+	if props := cypherMap(node.Properties, node.Key); props != "{}" {
+		sets = append(sets, "n += "+props)
+	}
+	for i, label := range node.Labels {
+		if i > 0 {
+			sets = append(sets, "n:"+cypherName(label))
+		}
+	}
+	if len(sets) > 0 {
+		fmt.Fprintf(w, " SET %s", strings.Join(sets, ", "))
+	}
+	w.WriteString(";\n")
+}
+
+func writeCypherRelationship(w *bufio.Writer, g *Graph, rel GraphRelationship) {
+	from, to := g.Nodes[g.nodes[rel.From]], g.Nodes[g.nodes[rel.To]]
+	fmt.Fprintf(w, "MATCH %s, %s MERGE (a)-[r:%s]->(b)", nodePattern("a", from), nodePattern("b", to), cypherName(rel.Type))
+	if len(rel.Properties) > 0 {
+		fmt.Fprintf(w, " SET r += %s", cypherMap(rel.Properties, nil))
+	}
+	w.WriteString(";\n")
+}
+
+// nodePattern matches node on its first label and key properties.
+func nodePattern(variable string, node GraphNode) string {
+	key := make(map[string]any, len(node.Key))
+	for _, k := range node.Key {
+		key[k] = node.Properties[k]
+	}
+	label := ""
+	if len(node.Labels) > 0 {
+		label = ":" + cypherName(node.Labels[0])
+	}
+	return fmt.Sprintf("(%s%s %s)", variable, label, cypherLiteral(key))
+}
+
+// cypherMap returns the map literal of props without the except properties.
+func cypherMap(props map[string]any, except []string) string {
+	m := make(map[string]any, len(props))
+	for k, v := range props {
+		if v != nil && !containsString(except, k) {
+			m[k] = v
+		}
+	}
+	return cypherLiteral(m)
+}
+
+var cypherEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// cypherLiteral returns v as a Cypher literal. Values without a literal,
+// such as structs, are written as their JSON string.
+func cypherLiteral(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "'" + cypherEscaper.Replace(v) + "'"
+	case bool:
+		return strconv.FormatBool(v)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return fmt.Sprint(v)
+	case float32:
+		return cypherLiteral(float64(v))
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "null"
+		}
+		s := strconv.FormatFloat(v, 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+		return s
+	case []any:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = cypherLiteral(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case []string:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = cypherLiteral(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fields := make([]string, len(keys))
+		for i, k := range keys {
+			fields[i] = cypherName(k) + ": " + cypherLiteral(v[k])
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return cypherLiteral(fmt.Sprint(v))
+	}
+	return cypherLiteral(string(data))
+}
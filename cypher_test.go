@@ -0,0 +1,145 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCypherFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "stacks.cypher")
+	if err := os.WriteFile(path, []byte("// previous script\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sink, err := NewCypherFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := sink.Write(context.Background(), graphReport()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Until closed, the script is in a temporary file next to path
+	if data, _ := os.ReadFile(path); string(data) != "// previous script\n" {
+		t.Errorf("%s = %q before Close; want it untouched", path, data)
+	}
+	temps, _ := filepath.Glob(path + ".*.tmp")
+	if len(temps) != 1 {
+		t.Fatalf("temporary files = %q; want one", temps)
+	}
+	if data, _ := os.ReadFile(temps[0]); !strings.Contains(string(data), "MERGE (a)-[r:`CALLS`]->(b) SET r += {`cpu_ns`: 20};\n") {
+		t.Errorf("temporary file does not contain the reports written:\n%s", data)
+	}
+
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+	if temps, _ := filepath.Glob(path + ".*.tmp"); len(temps) != 0 {
+		t.Errorf("temporary files %q remain after Close", temps)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+	for _, want := range []string{
+		"CREATE CONSTRAINT stack2graph_function_key IF NOT EXISTS FOR (n:Function) REQUIRE (n.name, n.package) IS UNIQUE;\n",
+		"MERGE (m:Stack2GraphMigration {version: 1}) ON CREATE SET m.description = 'unique keys of functions and attached nodes', m.appliedAt = datetime();\n",
+		"MERGE (n:`Function` {`name`: 'parse', `package`: 'github.com/acme/app/server'}) SET n += {`file`: '/app/server/parse.go', ",
+		"`self_cpu_ns`: 20}, n:`Service`;\n",
+		"MERGE (n:`Error` {`message`: 'bad request'});\n",
+		"MATCH (a:`Function` {`name`: '(*Server).handle', `package`: 'github.com/acme/app/server'}), (b:`Function` {`name`: 'parse', `package`: 'github.com/acme/app/server'}) MERGE (a)-[r:`CALLS`]->(b) SET r += {`cpu_ns`: 20};\n",
+		"MERGE (a)-[r:`ERROR_ORIGIN`]->(b) SET r += {`count`: 2};\n",
+		"MERGE (a)-[r:`SPAWNS`]->(b);\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script does not contain %q:\n%s", want, script)
+		}
+	}
+
+	lines := strings.Split(strings.TrimSpace(script), "\n")
+	schema := 1
+	for _, m := range schemaMigrations {
+		schema += len(m.statements) + 1
+	}
+	if len(lines) != schema+12 {
+		t.Fatalf("script has %d lines; want %d lines of schema and 6 statements per report:\n%s", len(lines), schema, script)
+	}
+	for _, line := range lines[schema:] {
+		if strings.Contains(line, "CREATE") || !strings.HasSuffix(line, ";") {
+			t.Errorf("statement %q is not a single MERGE", line)
+		}
+	}
+	// The statements of the last report set the totals of the weights
+	if last := lines[len(lines)-6:]; !strings.Contains(strings.Join(last, "\n"), "`self_cpu_ns`: 20}") {
+		t.Errorf("statements of the last report = %q; want the totals", last)
+	}
+}
+
+func TestCypherSinkWritesReportIDOnce(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewCypherSink(&buf)
+	report := graphReport()
+	report.ID = "0f1e"
+	for i := 0; i < 2; i++ {
+		if err := sink.Write(context.Background(), report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	if strings.Count(script, "MERGE (a)-[r:`CALLS`]->(b) SET r += {`cpu_ns`: 10};\n") != 1 || strings.Contains(script, "`cpu_ns`: 20}") {
+		t.Errorf("script does not write the replayed report once:\n%s", script)
+	}
+}
+
+func TestWriteCypher(t *testing.T) {
+	g := NewGraph()
+	g.Add(graphReport())
+	g.Add(graphReport())
+
+	var buf bytes.Buffer
+	if err := WriteCypher(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	script := buf.String()
+	if want := fmt.Sprintf("// stack2graph schema version %d\nCREATE CONSTRAINT ", len(schemaMigrations)); !strings.HasPrefix(script, want) {
+		t.Errorf("script does not start with the schema:\n%s", script)
+	}
+	if !strings.Contains(script, "MERGE (a)-[r:`ERROR_ORIGIN`]->(b) SET r += {`count`: 2};\n") || strings.Contains(script, "`count`: 1}") {
+		t.Errorf("script does not set only the totals of the weights:\n%s", script)
+	}
+}
+
+func TestCypherLiteral(t *testing.T) {
+	for _, tc := range []struct {
+		value any
+		want  string
+	}{
+		{"it's a \\ path\n", `'it\'s a \\ path\n'`},
+		{int64(3), "3"},
+		{2.0, "2.0"},
+		{1.5, "1.5"},
+		{true, "true"},
+		{nil, "null"},
+		{[]any{"a", 1}, "['a', 1]"},
+		{map[string]any{"b`c": "x", "a": 1}, "{`a`: 1, `b``c`: 'x'}"},
+		{struct{ A int }{1}, `'{"A":1}'`},
+	} {
+		if got := cypherLiteral(tc.value); got != tc.want {
+			t.Errorf("cypherLiteral(%#v) = %s; want %s", tc.value, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package stacktracetograph
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// defaultStackToGraph is the instance used by the package-level functions.
+var defaultStackToGraph atomic.Pointer[StackToGraph]
+
+// Default returns the default instance, or nil if none was set.
+func Default() *StackToGraph {
+	return defaultStackToGraph.Load()
+}
+
+// SetDefault makes s the instance used by the package-level functions, and
+// by the integrations created without an instance. It is safe to call while
+// other goroutines report; passing nil turns the package-level functions
+// back into no-ops.
+func SetDefault(s *StackToGraph) {
+	defaultStackToGraph.Store(s)
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying s. Reports made with the
+// returned context go to s instead of the default instance, so parallel
+// tests can each use their own sink.
+func NewContext(ctx context.Context, s *StackToGraph) context.Context {
+	return context.WithValue(ctx, contextKey{}, s)
+}
+
+// FromContext returns the instance carried by ctx, or the default instance.
+func FromContext(ctx context.Context) *StackToGraph {
+	if ctx != nil {
+		if s, ok := ctx.Value(contextKey{}).(*StackToGraph); ok && s != nil {
+			return s
+		}
+	}
+	return Default()
+}
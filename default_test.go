@@ -0,0 +1,62 @@
+//go:build !nostack2graph
+
+package stacktracetograph
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSetDefault(t *testing.T) {
+	previous := Default()
+	defer SetDefault(previous)
+
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+	SetDefault(s)
+
+	if Default() != s {
+		t.Fatalf("Default() did not return the instance passed to SetDefault")
+	}
+	if FromContext(context.Background()) != s {
+		t.Errorf("FromContext() without an instance did not fall back to Default()")
+	}
+	if err := ReportStacktrace(); err != nil {
+		t.Fatalf("ReportStacktrace() = %v", err)
+	}
+	if len(sink.Reports()) != 1 {
+		t.Errorf("default sink received %d reports; want 1", len(sink.Reports()))
+	}
+}
+
+func TestNewContextScopesReports(t *testing.T) {
+	for _, name := range []string{"first", "second", "third"} {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			sink := NewMemorySink()
+			s := NewStackToGraphWithSink(sink)
+			defer s.Close()
+			ctx := NewContext(context.Background(), s)
+
+			if FromContext(ctx) != s {
+				t.Fatalf("FromContext() did not return the instance of the context")
+			}
+			if err := ReportStacktraceContext(ctx); err != nil {
+				t.Fatalf("ReportStacktraceContext() = %v", err)
+			}
+			if err := ReportErrorContext(ctx, NewError(name)); err != nil {
+				t.Fatalf("ReportErrorContext() = %v", err)
+			}
+
+			reports := sink.Reports()
+			if len(reports) != 2 {
+				t.Fatalf("sink received %d reports; want 2", len(reports))
+			}
+			if a := reports[1].Attachments; len(a) != 1 || a[0].Key["message"] != name {
+				t.Errorf("error report attachments = %+v; want the error %q", a, name)
+			}
+		})
+	}
+}
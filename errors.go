@@ -0,0 +1,168 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// TracedError is an error that remembers the call stack where it was created.
+// It is compatible with errors.Is, errors.As and the %w verb, and is recorded
+// in the graph with ReportError once it is handled.
+type TracedError struct {
+	err      error
+	template string
+	pcs      []uintptr
+}
+
+// NewError returns an error with the given text that captures the stack of its caller.
+func NewError(text string) error {
+	return &TracedError{
+		err:      errors.New(text),
+		template: text,
+		pcs:      captureCallers(3),
+	}
+}
+
+// Errorf formats an error like fmt.Errorf and captures the stack of its caller.
+// The format string is used as the message template of the Error node.
+func Errorf(format string, args ...interface{}) error {
+	return &TracedError{
+		err:      fmt.Errorf(format, args...),
+		template: format,
+		pcs:      captureCallers(3),
+	}
+}
+
+// WrapError wraps err, capturing the stack of its caller. It returns nil if
+// err is nil and err itself if it already carries a stack.
+func WrapError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var traced *TracedError
+	if errors.As(err, &traced) {
+		return err
+	}
+	return &TracedError{
+		err:      err,
+		template: messageTemplate(err.Error()),
+		pcs:      captureCallers(3),
+	}
+}
+
+func (e *TracedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *TracedError) Unwrap() error {
+	return e.err
+}
+
+// Type returns the type name of the root cause of the error. Of errors
+// wrapping several errors, such as those of errors.Join or of fmt.Errorf
+// with several %w verbs, the first one is followed.
+func (e *TracedError) Type() string {
+	root := e.err
+	for {
+		var next error
+		switch err := root.(type) {
+		case interface{ Unwrap() error }:
+			next = err.Unwrap()
+		case interface{ Unwrap() []error }:
+			if errs := err.Unwrap(); len(errs) > 0 {
+				next = errs[0]
+			}
+		}
+		if next == nil {
+			break
+		}
+		root = next
+	}
+	return fmt.Sprintf("%T", root)
+}
+
+// Template returns the message template of the error, with variable parts
+// replaced by placeholders.
+func (e *TracedError) Template() string {
+	return e.template
+}
+
+// Stack returns the stack captured when the error was created, in the same
+// format as runtime.Stack.
+func (e *TracedError) Stack() string {
+	return formatCallers(e.pcs)
+}
+
+// ReportError records where err was created, linking the function that
+// created it to an Error node with an ERROR_ORIGIN relationship.
+// Errors that were not created by NewError, Errorf or WrapError are ignored.
+func (s *StackToGraph) ReportError(err error) error {
+	return s.ReportErrorContext(context.Background(), err)
+}
+
+// ReportErrorContext is like ReportError, writing the report with ctx.
+func (s *StackToGraph) ReportErrorContext(ctx context.Context, err error) error {
+	var traced *TracedError
+	if !errors.As(err, &traced) || !s.allowCapture() {
+		return nil
+	}
+
+	return s.reportStack(ctx, traced.Stack(), Attachment{
+		Label:        "Error",
+		Relationship: "ERROR_ORIGIN",
+		Key: map[string]interface{}{
+			"type":    traced.Type(),
+			"message": traced.Template(),
+		},
+		Properties: map[string]interface{}{
+			"example": traced.Error(),
+		},
+	})
+}
+
+// captureCallers records the program counters of the calling goroutine,
+// skipping the given number of frames.
+func captureCallers(skip int) []uintptr {
+	if !instrumented {
+		return nil
+	}
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(skip, pcs)
+	return pcs[:n]
+}
+
+// formatCallers renders program counters in the format of runtime.Stack so
+// they can go through parseStackTrace.
+func formatCallers(pcs []uintptr) string {
+	var sb strings.Builder
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		if frame.Function != "" {
+			fmt.Fprintf(&sb, "%s(...)\n\t%s:%d\n", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
+			break
+		}
+	}
+	return sb.String()
+}
+
+var (
+	quotedPattern = regexp.MustCompile(`"(?:[^"\\]|\\.)*"`)
+	hexPattern    = regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`)
+	numberPattern = regexp.MustCompile(`\b\d+(?:\.\d+)?`)
+)
+
+// messageTemplate replaces quoted strings and numbers in a message with
+// placeholders so errors differing only by their values share a template.
+func messageTemplate(message string) string {
+	message = quotedPattern.ReplaceAllString(message, "%q")
+	message = hexPattern.ReplaceAllString(message, "%x")
+	message = numberPattern.ReplaceAllString(message, "%d")
+	return message
+}
@@ -0,0 +1,120 @@
+package stacktracetograph
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestTracedErrorCompatibility(t *testing.T) {
+	err := Errorf("reading config %q: %w", "app.yaml", io.EOF)
+
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("errors.Is(%v, io.EOF) = false; want true", err)
+	}
+	var traced *TracedError
+	if !errors.As(fmt.Errorf("outer: %w", err), &traced) {
+		t.Fatalf("errors.As did not find the *TracedError")
+	}
+	if got, want := traced.Error(), `reading config "app.yaml": EOF`; got != want {
+		t.Errorf("Error() = %q; want %q", got, want)
+	}
+	if got, want := traced.Template(), "reading config %q: %w"; got != want {
+		t.Errorf("Template() = %q; want %q", got, want)
+	}
+	if got, want := traced.Type(), "*errors.errorString"; got != want {
+		t.Errorf("Type() = %q; want %q", got, want)
+	}
+}
+
+func TestTracedErrorTypeOfJoinedErrors(t *testing.T) {
+	for _, err := range []error{
+		Errorf("closing: %w", errors.Join(io.ErrUnexpectedEOF, errors.New("flush"))),
+		Errorf("copying %w from %w", io.ErrUnexpectedEOF, errors.New("source")),
+	} {
+		if got, want := err.(*TracedError).Type(), "*errors.errorString"; got != want {
+			t.Errorf("Type() of %v = %q; want %q", err, got, want)
+		}
+	}
+}
+
+func TestReportErrorOrigin(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	err := fmt.Errorf("handler: %w", Errorf("user %d not found", 42))
+	if err := s.ReportError(err); err != nil {
+		t.Fatalf("ReportError: %v", err)
+	}
+
+	reports := sink.Reports()
+	if len(reports) != 1 || len(reports[0].Attachments) != 1 {
+		t.Fatalf("sink received %+v; want one report with an Error", reports)
+	}
+	report, a := reports[0], reports[0].Attachments[0]
+	if a.Label != "Error" || a.Relationship != "ERROR_ORIGIN" ||
+		a.Key["type"] != "*errors.errorString" || a.Key["message"] != "user %d not found" || a.Properties["example"] != "user 42 not found" {
+		t.Errorf("attachment = %+v; want the Error created here", a)
+	}
+	// The error is linked to the first frame outside this package, the
+	// caller of the test function that created it here
+	if a.Frame < 1 || report.Stack[a.Frame-1].Function != "TestReportErrorOrigin" || report.Stack[a.Frame].Package != "testing" {
+		t.Errorf("error linked to frame %d of %+v; want the caller of the test", a.Frame, report.Stack)
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	if WrapError(nil) != nil {
+		t.Errorf("WrapError(nil) != nil")
+	}
+
+	traced := NewError("boom")
+	if WrapError(traced) != traced {
+		t.Errorf("WrapError re-wrapped an error that already carries a stack")
+	}
+
+	err := WrapError(fmt.Errorf("user 42 not found"))
+	if got, want := err.(*TracedError).Template(), "user %d not found"; got != want {
+		t.Errorf("Template() = %q; want %q", got, want)
+	}
+}
+
+func TestTracedErrorStack(t *testing.T) {
+	skipUninstrumented(t)
+	err := NewError("boom").(*TracedError)
+
+	stack := parseStackTrace(err.Stack())
+	if len(stack) == 0 {
+		t.Fatalf("parseStackTrace(%q) returned no frames", err.Stack())
+	}
+	// The first frame is the function that created the error
+	if got, want := stack[0].Function, "TestTracedErrorStack"; got != want {
+		t.Errorf("first frame function = %q; want %q", got, want)
+	}
+	if !strings.HasSuffix(stack[0].File, "errors_test.go") {
+		t.Errorf("first frame file = %q; want errors_test.go", stack[0].File)
+	}
+}
+
+func TestMessageTemplate(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"user 42 not found", "user %d not found"},
+		{`open "/tmp/a.txt": permission denied`, "open %q: permission denied"},
+		{"bad pointer 0x1400010aeb8", "bad pointer %x"},
+		{"retry after 1.5s", "retry after %ds"},
+		{"no values here", "no values here"},
+	}
+
+	for _, test := range tests {
+		if result := messageTemplate(test.input); result != test.expected {
+			t.Errorf("messageTemplate(%q) = %q; want %q", test.input, result, test.expected)
+		}
+	}
+}
@@ -28,11 +28,12 @@ func functionA() {
 }
 
 func main() {
-	s2g, err := stacktracetograph.NewStackToGraph("neo4j://localhost", "neo4j", "wallace123")
+	// Configured by STACK2GRAPH_URI, STACK2GRAPH_USERNAME, STACK2GRAPH_PASSWORD, ...
+	s2g, err := stacktracetograph.FromEnv()
 	if err != nil {
 		log.Fatalf("Failed to initialize Neo4j driver: %v", err)
 	}
-	s2g.SetupGlobal()
+	stacktracetograph.SetDefault(s2g)
 	defer s2g.Close()
 
 	// Simulate application flow
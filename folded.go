@@ -0,0 +1,70 @@
+package stacktracetograph
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// FoldedNaming selects how frames are named in folded stacks.
+type FoldedNaming int
+
+const (
+	// FoldedFunction names frames Receiver.Function, such as Server.handle.
+	FoldedFunction FoldedNaming = iota
+	// FoldedOriginalName names frames with the package and original name,
+	// such as github.com/x/y.(*Server).handle.func1.
+	FoldedOriginalName
+)
+
+// FoldedOptions configures WriteFolded.
+type FoldedOptions struct {
+	Naming FoldedNaming
+}
+
+// WriteFolded writes the reported stacks in the folded format. See WriteFolded.
+func (s *StackToGraph) WriteFolded(w io.Writer, opts FoldedOptions) error {
+	return WriteFolded(w, s.StackCounts(), opts)
+}
+
+// WriteFolded writes stacks in the folded stack format read by flamegraph.pl
+// and speedscope: one "root;caller;callee count" line per stack. Stacks with
+// the same names are merged and lines are sorted, so outputs can be diffed.
+func WriteFolded(w io.Writer, stacks []StackCount, opts FoldedOptions) error {
+	counts := make(map[string]int64)
+	for _, sc := range stacks {
+		if len(sc.Stack) == 0 {
+			continue
+		}
+		names := make([]string, len(sc.Stack))
+		for i, frame := range sc.Stack {
+			// Folded stacks start from the root
+			names[len(names)-1-i] = strings.ReplaceAll(opts.frameName(frame), ";", ":")
+		}
+		counts[strings.Join(names, ";")] += sc.Count
+	}
+
+	lines := make([]string, 0, len(counts))
+	for line := range counts {
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+
+	b := bufio.NewWriter(w)
+	for _, line := range lines {
+		fmt.Fprintf(b, "%s %d\n", line, counts[line])
+	}
+	return b.Flush()
+}
+
+func (o FoldedOptions) frameName(frame ParsedStackEntry) string {
+	if o.Naming == FoldedOriginalName {
+		return frameSymbol(frame)
+	}
+	if frame.Receiver != "" {
+		return frame.Receiver + "." + frame.Function
+	}
+	return frame.Function
+}
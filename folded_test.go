@@ -0,0 +1,37 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteFolded(t *testing.T) {
+	handle := ParsedStackEntry{Package: "github.com/acme/app", Receiver: "Server", Function: "handle", OriginalName: "(*Server).handle"}
+	serve := ParsedStackEntry{Package: "net/http", Function: "serve", OriginalName: "serve"}
+	query := ParsedStackEntry{Package: "github.com/acme/app", Function: "query", OriginalName: "query.func1"}
+
+	stacks := []StackCount{
+		{Stack: []ParsedStackEntry{query, handle, serve}, Count: 2},
+		{Stack: []ParsedStackEntry{handle, serve}, Count: 5},
+		{Stack: []ParsedStackEntry{query, handle, serve}, Count: 1},
+		{Stack: nil, Count: 4},
+	}
+
+	tests := []struct {
+		naming   FoldedNaming
+		expected string
+	}{
+		{FoldedFunction, "serve;Server.handle 5\nserve;Server.handle;query 3\n"},
+		{FoldedOriginalName, "net/http.serve;github.com/acme/app.(*Server).handle 5\n" +
+			"net/http.serve;github.com/acme/app.(*Server).handle;github.com/acme/app.query.func1 3\n"},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		if err := WriteFolded(&buf, stacks, FoldedOptions{Naming: test.naming}); err != nil {
+			t.Fatalf("WriteFolded() = %v", err)
+		}
+		if buf.String() != test.expected {
+			t.Errorf("WriteFolded(%v) =\n%s\nwant\n%s", test.naming, buf.String(), test.expected)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+//go:build !nostack2graph
+
+package stacktracetograph
+
+import "context"
+
+// instrumented is false when stack capture is compiled out by the
+// nostack2graph build tag.
+const instrumented = true
+
+// ReportStacktrace encapsulates capturing, parsing, and reporting the stack trace to Neo4j.
+// It does nothing until a default instance is set with SetDefault, so
+// instrumentation calls can stay in code that runs without a graph database.
+// Building with the nostack2graph tag compiles it to nothing.
+func ReportStacktrace() error {
+	s := Default()
+	if s == nil {
+		return nil
+	}
+	return s.ReportStacktrace()
+}
+
+// ReportStacktraceContext is like ReportStacktrace, reporting to the
+// instance carried by ctx if any.
+func ReportStacktraceContext(ctx context.Context) error {
+	s := FromContext(ctx)
+	if s == nil {
+		return nil
+	}
+	return s.ReportStacktraceContext(ctx)
+}
+
+// ReportError records where err was created using the default instance.
+// Like ReportStacktrace, it does nothing until a default instance is set.
+func ReportError(err error) error {
+	s := Default()
+	if s == nil {
+		return nil
+	}
+	return s.ReportError(err)
+}
+
+// ReportErrorContext is like ReportError, reporting to the instance carried
+// by ctx if any.
+func ReportErrorContext(ctx context.Context, err error) error {
+	s := FromContext(ctx)
+	if s == nil {
+		return nil
+	}
+	return s.ReportErrorContext(ctx, err)
+}
@@ -0,0 +1,29 @@
+//go:build nostack2graph
+
+package stacktracetograph
+
+import "context"
+
+// instrumented is false when stack capture is compiled out by the
+// nostack2graph build tag.
+const instrumented = false
+
+// ReportStacktrace does nothing: instrumentation is compiled out by the nostack2graph build tag.
+func ReportStacktrace() error {
+	return nil
+}
+
+// ReportStacktraceContext does nothing: instrumentation is compiled out by the nostack2graph build tag.
+func ReportStacktraceContext(ctx context.Context) error {
+	return nil
+}
+
+// ReportError does nothing: instrumentation is compiled out by the nostack2graph build tag.
+func ReportError(err error) error {
+	return nil
+}
+
+// ReportErrorContext does nothing: instrumentation is compiled out by the nostack2graph build tag.
+func ReportErrorContext(ctx context.Context, err error) error {
+	return nil
+}
@@ -0,0 +1,72 @@
+package stacktracetograph
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestGlobalDefaultIsNoop(t *testing.T) {
+	previous := Default()
+	SetDefault(nil)
+	defer SetDefault(previous)
+
+	if err := ReportStacktrace(); err != nil {
+		t.Errorf("ReportStacktrace() without a global instance = %v; want nil", err)
+	}
+	if err := ReportError(NewError("boom")); err != nil {
+		t.Errorf("ReportError() without a global instance = %v; want nil", err)
+	}
+}
+
+func TestSetEnabled(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	s.SetEnabled(false)
+	if s.Enabled() {
+		t.Errorf("Enabled() = true after SetEnabled(false)")
+	}
+	s.ReportStacktrace()
+	if len(sink.Reports()) != 0 {
+		t.Errorf("disabled StackToGraph wrote %d reports", len(sink.Reports()))
+	}
+
+	s.SetEnabled(true)
+	s.ReportStacktrace()
+	if len(sink.Reports()) != 1 {
+		t.Errorf("enabled StackToGraph wrote %d reports; want 1", len(sink.Reports()))
+	}
+}
+
+// skipUninstrumented skips tests of stack capture when it is compiled out by
+// the nostack2graph build tag.
+func skipUninstrumented(t *testing.T) {
+	t.Helper()
+	if !instrumented {
+		t.Skip("stack capture is compiled out by the nostack2graph build tag")
+	}
+}
+
+func TestCaptureCompiledOut(t *testing.T) {
+	if instrumented {
+		t.Skip("stack capture is compiled out only by the nostack2graph build tag")
+	}
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	s.ReportStacktrace()
+	s.StartSpan(context.Background())()
+	s.ReportError(NewError("boom"))
+	slog.New(NewSlogHandler(slog.NewTextHandler(io.Discard, nil), s, SlogHandlerOptions{})).Error("boom")
+	if reports := sink.Reports(); len(reports) != 0 {
+		t.Errorf("sink received %+v; want no report with the nostack2graph tag", reports)
+	}
+	if stack := NewError("boom").(*TracedError).Stack(); stack != "" {
+		t.Errorf("NewError captured %q; want no stack", stack)
+	}
+}
@@ -1,9 +1,13 @@
 module github.com/wricardo/stacktrace-to-graph
 
-go 1.23.0
+go 1.24.0
+
+require (
+	github.com/google/pprof v0.0.0-20250403155104-27863c87afa6
+	github.com/neo4j/neo4j-go-driver/v5 v5.24.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/neo4j/neo4j-go-driver/v5 v5.24.0 // indirect
 	github.com/sashabaranov/go-openai v1.30.0 // indirect
 )
@@ -0,0 +1,220 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoroutineSnapshot is the state of every goroutine at one point in time,
+// with identical stacks grouped together.
+type GoroutineSnapshot struct {
+	Time   time.Time
+	Total  int              // number of goroutines
+	Groups []GoroutineGroup // largest groups first
+}
+
+// GoroutineGroup is a set of goroutines with the same state and stack.
+type GoroutineGroup struct {
+	Signature   string // identifies the stack, ignoring argument values
+	State       string // chan receive, select, IO wait, running, ...
+	Count       int
+	IDs         []int64
+	WaitMinutes int // longest time a goroutine of the group has been blocked
+	Stack       []ParsedStackEntry
+	Spawns      []Spawn // creators of the first goroutine of the group
+}
+
+// goroutineStack is one goroutine of a runtime.Stack dump.
+type goroutineStack struct {
+	id          int64
+	state       string
+	waitMinutes int
+	trace       string // frames and creators, see parseGoroutineTrace
+}
+
+// goroutineHeader matches the first line of each goroutine in a dump, such as
+// "goroutine 7 [chan receive, 3 minutes]:".
+var goroutineHeader = regexp.MustCompile(`^goroutine (\d+)(?: [^\[]*)? \[([^\]]*)\]:$`)
+
+var waitMinutesPattern = regexp.MustCompile(`^(\d+) minutes?$`)
+
+// CaptureGoroutines captures and groups the stacks of every goroutine
+// without reporting them.
+func CaptureGoroutines() GoroutineSnapshot {
+	return groupGoroutines(time.Now(), parseGoroutineDump(captureAllStacks()))
+}
+
+// SnapshotAllGoroutines captures the stacks of every goroutine and reports
+// each group of identical stacks, linking the function where the goroutines
+// are blocked to a GoroutineGroup node holding their state and count.
+// Groups are reported on every snapshot, without skipping the ones
+// already reported, so the counts stay current.
+func (s *StackToGraph) SnapshotAllGoroutines(ctx context.Context) (GoroutineSnapshot, error) {
+	if !s.Enabled() {
+		return GoroutineSnapshot{}, nil
+	}
+
+	snapshot := CaptureGoroutines()
+	var errs []error
+	for _, group := range snapshot.Groups {
+		stack := s.filterFrames(append([]ParsedStackEntry(nil), group.Stack...))
+		s.metrics.stacksCaptured.Add(1)
+		s.metrics.framesPerStack.observe(framesPerStackBounds, float64(len(stack)))
+
+		attachment := Attachment{
+			Label:        "GoroutineGroup",
+			Relationship: "HAS_GOROUTINES",
+			SkipPackages: []string{"runtime"},
+			Key: map[string]interface{}{
+				"signature": group.Signature,
+				"state":     group.State,
+			},
+			Properties: map[string]interface{}{
+				"count":       group.Count,
+				"waitMinutes": group.WaitMinutes,
+				"snapshotAt":  snapshot.Time.UTC().Format(time.RFC3339),
+			},
+		}
+		// Goroutines blocked in the runtime are linked from their top frame
+		if attachment.Frame = originFrame(stack, attachment.SkipPackages...); attachment.Frame < 0 && len(stack) > 0 {
+			attachment.Frame = 0
+		}
+
+		report := Report{
+			Stack:       stack,
+			Attachments: []Attachment{attachment},
+			Spawns:      s.filterSpawns(append([]Spawn(nil), group.Spawns...)),
+			Labels:      s.labels,
+			Time:        snapshot.Time,
+		}
+		if err := s.submit(ctx, "", report); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if s.leaks != nil {
+		for _, suspect := range s.leaks.Observe(snapshot) {
+			if err := s.reportLeak(ctx, suspect); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return snapshot, errors.Join(errs...)
+}
+
+// snapshotGoroutinesEvery reports a goroutine snapshot every interval until
+// stop is closed.
+func (s *StackToGraph) snapshotGoroutinesEvery(interval time.Duration, stop <-chan struct{}, done *sync.WaitGroup) {
+	defer done.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			// Write errors are already logged
+			s.SnapshotAllGoroutines(context.Background())
+		}
+	}
+}
+
+// captureAllStacks returns the stacks of all goroutines, growing the buffer
+// until the dump fits.
+func captureAllStacks() string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// traceGoroutineID returns the id of the goroutine of a trace captured by
+// runtime.Stack, or 0 if the trace has no goroutine header.
+func traceGoroutineID(trace string) int64 {
+	header, _, _ := strings.Cut(trace, "\n")
+	match := goroutineHeader.FindStringSubmatch(header)
+	if match == nil {
+		return 0
+	}
+	id, _ := strconv.ParseInt(match[1], 10, 64)
+	return id
+}
+
+// parseGoroutineDump splits a dump of all goroutines into goroutines.
+func parseGoroutineDump(dump string) []goroutineStack {
+	var goroutines []goroutineStack
+	for _, block := range strings.Split(dump, "\n\n") {
+		header, body, _ := strings.Cut(strings.TrimSpace(block), "\n")
+		match := goroutineHeader.FindStringSubmatch(header)
+		if match == nil {
+			continue
+		}
+
+		g := goroutineStack{}
+		g.id, _ = strconv.ParseInt(match[1], 10, 64)
+		status := strings.Split(match[2], ", ")
+		g.state = status[0]
+		for _, part := range status[1:] {
+			if m := waitMinutesPattern.FindStringSubmatch(part); m != nil {
+				g.waitMinutes, _ = strconv.Atoi(m[1])
+			}
+		}
+		g.trace = body
+		goroutines = append(goroutines, g)
+	}
+	return goroutines
+}
+
+// groupGoroutines groups the goroutines with the same state and frames.
+func groupGoroutines(now time.Time, goroutines []goroutineStack) GoroutineSnapshot {
+	snapshot := GoroutineSnapshot{Time: now, Total: len(goroutines)}
+	index := make(map[string]int)
+	for _, g := range goroutines {
+		stack, spawns := parseGoroutineTrace(g.trace)
+		signature := stackSignature(stack)
+		key := signature + "\n" + g.state
+
+		i, ok := index[key]
+		if !ok {
+			i = len(snapshot.Groups)
+			index[key] = i
+			snapshot.Groups = append(snapshot.Groups, GoroutineGroup{
+				Signature: signature,
+				State:     g.state,
+				Stack:     stack,
+				Spawns:    spawns,
+			})
+		}
+		group := &snapshot.Groups[i]
+		group.Count++
+		group.IDs = append(group.IDs, g.id)
+		group.WaitMinutes = max(group.WaitMinutes, g.waitMinutes)
+	}
+
+	sort.SliceStable(snapshot.Groups, func(i, j int) bool {
+		return snapshot.Groups[i].Count > snapshot.Groups[j].Count
+	})
+	return snapshot
+}
+
+// stackSignature identifies a parsed stack by its functions and lines.
+func stackSignature(stack []ParsedStackEntry) string {
+	var b strings.Builder
+	for _, frame := range stack {
+		fmt.Fprintf(&b, "%s.%s %s:%s\n", frame.Package, frame.OriginalName, frame.File, frame.Line)
+	}
+	return stackHash(b.String())
+}
@@ -0,0 +1,125 @@
+package stacktracetograph
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+const goroutineDump = `goroutine 1 [running]:
+main.main()
+	/app/main.go:12 +0x1d
+
+goroutine 7 [chan receive, 3 minutes]:
+main.worker(0xc000010000)
+	/app/worker.go:20 +0x2a
+created by main.start in goroutine 1
+	/app/main.go:10 +0x45
+
+goroutine 8 [chan receive]:
+main.worker(0xc000010008)
+	/app/worker.go:20 +0x2a
+created by main.start in goroutine 1
+	/app/main.go:10 +0x45
+`
+
+func TestParseGoroutineDump(t *testing.T) {
+	goroutines := parseGoroutineDump(goroutineDump)
+	if len(goroutines) != 3 {
+		t.Fatalf("parseGoroutineDump() returned %d goroutines; want 3", len(goroutines))
+	}
+
+	g := goroutines[1]
+	if g.id != 7 || g.state != "chan receive" || g.waitMinutes != 3 {
+		t.Errorf("goroutine = %+v; want goroutine 7 blocked in chan receive for 3 minutes", g)
+	}
+
+	snapshot := groupGoroutines(time.Now(), goroutines)
+	if snapshot.Total != 3 || len(snapshot.Groups) != 2 {
+		t.Fatalf("groupGoroutines() = %+v; want 3 goroutines in 2 groups", snapshot)
+	}
+	if group := snapshot.Groups[0]; group.Count != 2 || group.WaitMinutes != 3 || group.Stack[0].Function != "worker" {
+		t.Errorf("largest group = %+v; want the 2 workers", group)
+	}
+	if spawns := snapshot.Groups[0].Spawns; len(spawns) != 1 || spawns[0].Creator.Function != "start" || spawns[0].ParentGoroutine != 1 {
+		t.Errorf("spawns of the workers = %+v; want created by main.start in goroutine 1", spawns)
+	}
+}
+
+func TestSnapshotAllGoroutines(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	for i := 0; i < 3; i++ {
+		go func() { <-release }()
+	}
+
+	// Wait for the goroutines to block
+	deadline := time.Now().Add(5 * time.Second)
+	for blockedGroup(CaptureGoroutines()) == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	snapshot, err := s.SnapshotAllGoroutines(context.Background())
+	if err != nil {
+		t.Fatalf("SnapshotAllGoroutines() = %v", err)
+	}
+	blocked := blockedGroup(snapshot)
+	if blocked == nil {
+		t.Fatalf("snapshot %+v has no group of the 3 blocked goroutines", snapshot.Groups)
+	}
+
+	reports := sink.Reports()
+	if len(reports) != len(snapshot.Groups) {
+		t.Fatalf("sink received %d reports; want one per group (%d)", len(reports), len(snapshot.Groups))
+	}
+	for _, report := range reports {
+		a := report.Attachments[0]
+		if a.Key["signature"] == blocked.Signature {
+			if a.Label != "GoroutineGroup" || a.Properties["count"] != blocked.Count {
+				t.Errorf("attachment = %+v; want a GoroutineGroup with count %d", a, blocked.Count)
+			}
+			return
+		}
+	}
+	t.Errorf("no report for the group of blocked goroutines")
+}
+
+// blockedGroup returns the group of the goroutines started by TestSnapshotAllGoroutines.
+func blockedGroup(snapshot GoroutineSnapshot) *GoroutineGroup {
+	for i, group := range snapshot.Groups {
+		if group.State != "chan receive" || group.Count < 3 {
+			continue
+		}
+		// Runtime frames are only listed with GOTRACEBACK=system
+		for _, frame := range group.Stack {
+			if frame.Package != "runtime" {
+				if frame.Function == "TestSnapshotAllGoroutines" {
+					return &snapshot.Groups[i]
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func TestWithGoroutineSnapshots(t *testing.T) {
+	sink := NewMemorySink()
+	s, err := New(WithSink(sink), WithGoroutineSnapshots(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.Reports()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Close()
+	if len(sink.Reports()) == 0 {
+		t.Errorf("no goroutine snapshot was reported")
+	}
+}
@@ -0,0 +1,256 @@
+package stacktracetograph
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Graph is an in-memory copy of the graph written by reports: the Function
+// nodes, the nodes attached to them and the relationships between them,
+// merged the same way as by Neo4jSink. A Graph is a Sink, so reports can be
+// collected or replayed into it and exported.
+type Graph struct {
+	Nodes         []GraphNode
+	Relationships []GraphRelationship
+
+	mu            sync.Mutex
+	nodes         map[string]int      // index of the node by id
+	relationships map[string]int      // index of the relationship by from, type and to
+	applied       map[string]struct{} // IDs of the weighted reports added
+}
+
+// GraphNode is a node of a Graph.
+type GraphNode struct {
+	ID         string         `json:"id"`
+	Labels     []string       `json:"labels"`
+	Key        []string       `json:"key,omitempty"` // properties the node is merged on
+	Properties map[string]any `json:"properties"`
+}
+
+// GraphRelationship is a relationship of a Graph.
+type GraphRelationship struct {
+	Type       string         `json:"type"`
+	From       string         `json:"from"`
+	To         string         `json:"to"`
+	Properties map[string]any `json:"properties,omitempty"`
+}
+
+// NewGraph returns an empty Graph.
+func NewGraph() *Graph {
+	return &Graph{}
+}
+
+// Write merges the report into the graph.
+func (g *Graph) Write(ctx context.Context, report Report) error {
+	g.Add(report)
+	return nil
+}
+
+// Close does nothing; the graph remains available.
+func (g *Graph) Close() error {
+	return nil
+}
+
+// Add merges the functions of the report, the CALLS relationships between
+// them, its attachments and its spawns into the graph. Like Neo4jSink, it
+// ignores a report whose ID was already added, so its weights are added
+// once when it is retried or replayed.
+func (g *Graph) Add(report Report) {
+	g.add(report)
+}
+
+// add adds the report and reports whether it was not already added.
+func (g *Graph) add(report Report) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if report.ID != "" {
+		if _, ok := g.applied[report.ID]; ok {
+			return false
+		}
+		if g.applied == nil {
+			g.applied = make(map[string]struct{})
+		}
+		g.applied[report.ID] = struct{}{}
+	}
+
+	ids := g.mergeStack(report.Stack, report.Labels, report.Weights)
+
+	for _, a := range report.Attachments {
+		if a.Frame < 0 || a.Frame >= len(ids) {
+			continue
+		}
+		key, _ := json.Marshal(a.Key)
+		id := fmt.Sprintf("%s:%s", a.Label, key)
+		keys := make([]string, 0, len(a.Key))
+		for k := range a.Key {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		node := g.mergeNode(id, []string{a.Label}, keys)
+		for k, v := range a.Key {
+			node.Properties[k] = v
+		}
+		for k, v := range a.Properties {
+			node.Properties[k] = v
+		}
+		g.mergeRelationship(ids[a.Frame], a.Relationship, id, a.Weights)
+	}
+
+	for _, spawn := range report.Spawns {
+		creatorStack := spawn.CreatorStack
+		if len(creatorStack) == 0 {
+			creatorStack = []ParsedStackEntry{spawn.Creator}
+		}
+		creator := g.mergeStack(creatorStack, report.Labels, nil)[0]
+		entry := g.mergeStack([]ParsedStackEntry{spawn.Entry}, report.Labels, nil)[0]
+		g.mergeRelationship(creator, "SPAWNS", entry, nil)
+	}
+	return true
+}
+
+// Node returns the node with the given id.
+func (g *Graph) Node(id string) (GraphNode, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.index()
+	i, ok := g.nodes[id]
+	if !ok {
+		return GraphNode{}, false
+	}
+	return g.Nodes[i], true
+}
+
+// mergeStack merges the functions of stack and the CALLS relationships
+// between them, and returns the ids of the function nodes.
+func (g *Graph) mergeStack(stack []ParsedStackEntry, labels []string, weights map[string]int64) []string {
+	ids := make([]string, len(stack))
+	for i, frame := range stack {
+		ids[i] = functionID(frame)
+		node := g.mergeNode(ids[i], append([]string{"Function"}, labels...), functionKey)
+		for k, v := range functionProperties(frame) {
+			node.Properties[k] = v
+		}
+	}
+	for i := len(stack) - 1; i > 0; i-- {
+		g.mergeRelationship(ids[i], "CALLS", ids[i-1], weights)
+	}
+	if len(ids) > 0 && len(weights) > 0 {
+		top := &g.Nodes[g.nodes[ids[0]]]
+		for name, value := range weights {
+			top.Properties["self_"+name] = toInt64(top.Properties["self_"+name]) + value
+		}
+	}
+	return ids
+}
+
+func (g *Graph) mergeNode(id string, labels, key []string) *GraphNode {
+	g.index()
+	i, ok := g.nodes[id]
+	if !ok {
+		i = len(g.Nodes)
+		g.nodes[id] = i
+		g.Nodes = append(g.Nodes, GraphNode{ID: id, Key: key, Properties: make(map[string]any)})
+	}
+	node := &g.Nodes[i]
+	for _, label := range labels {
+		if !containsString(node.Labels, label) {
+			node.Labels = append(node.Labels, label)
+		}
+	}
+	return node
+}
+
+func (g *Graph) mergeRelationship(from, typ, to string, weights map[string]int64) {
+	g.index()
+	key := relationshipKey(from, typ, to)
+	i, ok := g.relationships[key]
+	if !ok {
+		i = len(g.Relationships)
+		g.relationships[key] = i
+		g.Relationships = append(g.Relationships, GraphRelationship{Type: typ, From: from, To: to})
+	}
+	rel := &g.Relationships[i]
+	if len(weights) > 0 && rel.Properties == nil {
+		rel.Properties = make(map[string]any)
+	}
+	for name, value := range weights {
+		rel.Properties[name] = toInt64(rel.Properties[name]) + value
+	}
+}
+
+// index builds the indexes of a graph decoded from JSON.
+func (g *Graph) index() {
+	if g.nodes != nil {
+		return
+	}
+	g.nodes = make(map[string]int, len(g.Nodes))
+	for i, node := range g.Nodes {
+		g.nodes[node.ID] = i
+	}
+	g.relationships = make(map[string]int, len(g.Relationships))
+	for i, rel := range g.Relationships {
+		g.relationships[relationshipKey(rel.From, rel.Type, rel.To)] = i
+	}
+}
+
+// relationshipKey identifies a relationship in the index of a graph.
+func relationshipKey(from, typ, to string) string {
+	return from + "\x00" + typ + "\x00" + to
+}
+
+// functionKey are the properties Function nodes are merged on.
+var functionKey = []string{"name", "package"}
+
+// functionID identifies the Function node of a frame, which is merged on
+// its name and package.
+func functionID(frame ParsedStackEntry) string {
+	return "Function:" + frame.Package + "." + frame.OriginalName
+}
+
+// functionProperties returns the properties of the Function node of a
+// frame, as set by Neo4jSink.
+func functionProperties(frame ParsedStackEntry) map[string]any {
+	return map[string]any{
+		"name":                   frame.OriginalName,
+		"receiver":               frame.Receiver,
+		"function":               frame.Function,
+		"file":                   frame.File,
+		"line":                   frame.Line,
+		"package":                frame.Package,
+		"packageName":            frame.PackageName,
+		"repository":             frame.Repository,
+		"repositoryOrganization": frame.RepositoryOrganization,
+		"repositoryName":         frame.RepositoryName,
+		"folder":                 frame.Folder,
+		"folderName":             frame.FolderName,
+	}
+}
+
+// toInt64 converts a weight, which may have been decoded from JSON.
+func toInt64(v any) int64 {
+	switch v := v.(type) {
+	case int64:
+		return v
+	case int:
+		return int64(v)
+	case float64:
+		return int64(v)
+	case json.Number:
+		i, _ := v.Int64()
+		return i
+	}
+	return 0
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
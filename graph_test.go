@@ -0,0 +1,120 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+)
+
+// graphReport returns a report of handle calling parse, with a weight and an
+// error attached to parse.
+func graphReport() Report {
+	stack := parseStackTrace("github.com/acme/app/server.parse(...)\n\t/app/server/parse.go:12\n" +
+		"github.com/acme/app/server.(*Server).handle(...)\n\t/app/server/server.go:40\n")
+	return Report{
+		Stack: stack,
+		Attachments: []Attachment{{
+			Label:        "Error",
+			Relationship: "ERROR_ORIGIN",
+			Key:          map[string]interface{}{"message": "bad request"},
+			Weights:      map[string]int64{"count": 1},
+		}},
+		Spawns:  []Spawn{{Creator: stack[1], Entry: stack[0]}},
+		Labels:  []string{"Service"},
+		Weights: map[string]int64{"cpu_ns": 10},
+	}
+}
+
+func TestGraphAdd(t *testing.T) {
+	g := NewGraph()
+	if err := g.Write(context.Background(), graphReport()); err != nil {
+		t.Fatal(err)
+	}
+	g.Add(graphReport())
+
+	if len(g.Nodes) != 3 || len(g.Relationships) != 3 {
+		t.Fatalf("graph has %d nodes and %d relationships; want 3 and 3: %+v", len(g.Nodes), len(g.Relationships), g)
+	}
+	parse, ok := g.Node("Function:github.com/acme/app/server.parse")
+	if !ok {
+		t.Fatalf("no parse node in %+v", g.Nodes)
+	}
+	if parse.Properties["function"] != "parse" || parse.Properties["line"] != "12" || parse.Properties["self_cpu_ns"] != int64(20) {
+		t.Errorf("parse properties = %v", parse.Properties)
+	}
+	if len(parse.Labels) != 2 || parse.Labels[1] != "Service" {
+		t.Errorf("parse labels = %v; want Function and Service", parse.Labels)
+	}
+
+	types := make(map[string]GraphRelationship)
+	for _, rel := range g.Relationships {
+		types[rel.Type] = rel
+	}
+	if calls := types["CALLS"]; calls.From != "Function:github.com/acme/app/server.(*Server).handle" || calls.Properties["cpu_ns"] != int64(20) {
+		t.Errorf("CALLS = %+v; want handle calling parse twice", calls)
+	}
+	if origin := types["ERROR_ORIGIN"]; origin.Properties["count"] != int64(2) {
+		t.Errorf("ERROR_ORIGIN = %+v; want a count of 2", origin)
+	}
+	if spawns := types["SPAWNS"]; spawns.To != parse.ID {
+		t.Errorf("SPAWNS = %+v; want handle spawning parse", spawns)
+	}
+}
+
+func TestGraphAddsReportIDOnce(t *testing.T) {
+	report := graphReport()
+	report.ID = "0f1e"
+	var buf bytes.Buffer
+	sink := NewNDJSONSink(&buf)
+	for i := 0; i < 2; i++ {
+		sink.Write(context.Background(), report)
+	}
+
+	g := NewGraph()
+	if _, err := ReplayNDJSON(context.Background(), g, &buf); err != nil {
+		t.Fatal(err)
+	}
+	g.Add(graphReport())
+	for _, rel := range g.Relationships {
+		if rel.Type == "CALLS" && rel.Properties["cpu_ns"] != int64(20) {
+			t.Errorf("CALLS = %+v; want the weights of the replayed report once and of the report without ID", rel)
+		}
+		if rel.Type == "ERROR_ORIGIN" && rel.Properties["count"] != int64(2) {
+			t.Errorf("ERROR_ORIGIN = %+v; want the weights of the replayed report once and of the report without ID", rel)
+		}
+	}
+}
+
+func TestGraphJSON(t *testing.T) {
+	g := NewGraph()
+	g.Add(graphReport())
+	data, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded := NewGraph()
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatalf("Unmarshal() = %v\n%s", err, data)
+	}
+	if parse, _ := decoded.Node("Function:github.com/acme/app/server.parse"); parse.Properties["self_cpu_ns"] != int64(10) {
+		t.Errorf("decoded parse properties = %v; want integer weights", parse.Properties)
+	}
+	decoded.Add(graphReport())
+	if len(decoded.Nodes) != 3 || len(decoded.Relationships) != 3 {
+		t.Fatalf("decoded graph has %d nodes and %d relationships; want 3 and 3", len(decoded.Nodes), len(decoded.Relationships))
+	}
+	for _, rel := range decoded.Relationships {
+		if rel.Type == "CALLS" && rel.Properties["cpu_ns"] != int64(20) {
+			t.Errorf("CALLS = %+v; want the weights of both reports", rel)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"version":2,"nodes":[]}`), NewGraph()); err == nil {
+		t.Errorf("Unmarshal() of a newer schema version succeeded")
+	}
+	if data, _ := json.Marshal(NewGraph()); string(data) != `{"version":1,"nodes":[],"relationships":[]}` {
+		t.Errorf("empty graph = %s", data)
+	}
+}
@@ -0,0 +1,314 @@
+package stacktracetograph
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// GEXFOptions configures WriteGEXF.
+type GEXFOptions struct {
+	// Weight is the relationship property, such as cpu_ns, used as the
+	// weight of the edges by Gephi layouts. Edges without it weigh 1.
+	Weight string
+}
+
+// WriteGraphML writes the graph as GraphML, read by yEd and Gephi. Every
+// node and relationship property is a data key, next to the label shown for
+// nodes, the labels of the nodes and the type of the relationships.
+func WriteGraphML(w io.Writer, g *Graph) error {
+	nodes, edges := g.exportAttributes()
+	nodeAttrs, edgeAttrs := graphAttributes(nodes), graphAttributes(edges)
+
+	doc := graphMLDocument{
+		Xmlns: "http://graphml.graphdrawing.org/xmlns",
+		Graph: graphMLGraph{ID: "stack2graph", EdgeDefault: "directed"},
+	}
+	for i, attr := range nodeAttrs {
+		doc.Keys = append(doc.Keys, graphMLKey{ID: "n" + strconv.Itoa(i), For: "node", Name: attr.name, Type: attr.typ})
+	}
+	for i, attr := range edgeAttrs {
+		doc.Keys = append(doc.Keys, graphMLKey{ID: "e" + strconv.Itoa(i), For: "edge", Name: attr.name, Type: attr.typ})
+	}
+	for _, node := range nodes {
+		n := graphMLNode{ID: node.id}
+		for i, attr := range nodeAttrs {
+			if v, ok := node.values[attr.name]; ok {
+				n.Data = append(n.Data, graphMLData{Key: "n" + strconv.Itoa(i), Value: attributeValue(v)})
+			}
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, n)
+	}
+	for i, edge := range edges {
+		e := graphMLEdge{ID: "e" + strconv.Itoa(i), Source: edge.from, Target: edge.to}
+		for j, attr := range edgeAttrs {
+			if v, ok := edge.values[attr.name]; ok {
+				e.Data = append(e.Data, graphMLData{Key: "e" + strconv.Itoa(j), Value: attributeValue(v)})
+			}
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, e)
+	}
+
+	return writeXML(w, doc)
+}
+
+// WriteGEXF writes the graph as GEXF 1.3, read by Gephi. Properties are
+// node and edge attributes, like in WriteGraphML.
+func WriteGEXF(w io.Writer, g *Graph, opts GEXFOptions) error {
+	nodes, edges := g.exportAttributes()
+	nodeAttrs, edgeAttrs := graphAttributes(nodes), graphAttributes(edges)
+
+	doc := gexfDocument{
+		Xmlns:   "http://gexf.net/1.3",
+		Version: "1.3",
+		Graph: gexfGraph{
+			DefaultEdgeType: "directed",
+			Mode:            "static",
+		},
+	}
+	nodeClass := gexfAttributes{Class: "node"}
+	for i, attr := range nodeAttrs {
+		nodeClass.Attributes = append(nodeClass.Attributes, gexfAttribute{ID: strconv.Itoa(i), Title: attr.name, Type: attr.typ})
+	}
+	edgeClass := gexfAttributes{Class: "edge"}
+	for i, attr := range edgeAttrs {
+		edgeClass.Attributes = append(edgeClass.Attributes, gexfAttribute{ID: strconv.Itoa(i), Title: attr.name, Type: attr.typ})
+	}
+	doc.Graph.Attributes = []gexfAttributes{nodeClass, edgeClass}
+
+	for _, node := range nodes {
+		n := gexfNode{ID: node.id, Label: attributeValue(node.values["label"])}
+		for i, attr := range nodeAttrs {
+			if v, ok := node.values[attr.name]; ok {
+				n.Values = append(n.Values, gexfValue{For: strconv.Itoa(i), Value: attributeValue(v)})
+			}
+		}
+		doc.Graph.Nodes = append(doc.Graph.Nodes, n)
+	}
+	for i, edge := range edges {
+		e := gexfEdge{ID: strconv.Itoa(i), Source: edge.from, Target: edge.to, Label: edge.typ}
+		if v, ok := edge.values[opts.Weight]; ok && opts.Weight != "" {
+			e.Weight = attributeValue(v)
+		}
+		for j, attr := range edgeAttrs {
+			if v, ok := edge.values[attr.name]; ok {
+				e.Values = append(e.Values, gexfValue{For: strconv.Itoa(j), Value: attributeValue(v)})
+			}
+		}
+		doc.Graph.Edges = append(doc.Graph.Edges, e)
+	}
+
+	return writeXML(w, doc)
+}
+
+func writeXML(w io.Writer, doc any) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// exportedElement is a node or relationship with the values exported as
+// its attributes.
+type exportedElement struct {
+	id, from, to, typ string
+	values            map[string]any
+}
+
+// exportAttributes returns the nodes and relationships of the graph with
+// their properties, the label shown for nodes, the labels of the nodes and
+// the type of the relationships.
+func (g *Graph) exportAttributes() (nodes, edges []exportedElement) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, node := range g.Nodes {
+		values := make(map[string]any, len(node.Properties)+2)
+		for k, v := range node.Properties {
+			values[k] = v
+		}
+		values["label"] = nodeLabel(node)
+		values["labels"] = strings.Join(node.Labels, ",")
+		nodes = append(nodes, exportedElement{id: node.ID, values: values})
+	}
+	for _, rel := range g.Relationships {
+		values := make(map[string]any, len(rel.Properties)+1)
+		for k, v := range rel.Properties {
+			values[k] = v
+		}
+		values["type"] = rel.Type
+		edges = append(edges, exportedElement{from: rel.From, to: rel.To, typ: rel.Type, values: values})
+	}
+	return nodes, edges
+}
+
+// nodeLabel names functions Receiver.Function, like folded stacks, and other
+// nodes by their id.
+func nodeLabel(node GraphNode) string {
+	function, _ := node.Properties["function"].(string)
+	if function == "" {
+		return node.ID
+	}
+	if receiver, _ := node.Properties["receiver"].(string); receiver != "" {
+		return receiver + "." + function
+	}
+	return function
+}
+
+// graphAttribute is an attribute of the exported nodes or relationships,
+// typed with the GraphML and GEXF type names.
+type graphAttribute struct {
+	name, typ string
+}
+
+// graphAttributes returns the attributes of elements sorted by name. An
+// attribute with values of different types is a string, or a double for
+// integers and floats.
+func graphAttributes(elements []exportedElement) []graphAttribute {
+	types := make(map[string]string)
+	for _, element := range elements {
+		for name, v := range element.values {
+			typ := attributeType(v)
+			switch previous, ok := types[name]; {
+			case !ok || previous == typ:
+				types[name] = typ
+			case (previous == "long" && typ == "double") || (previous == "double" && typ == "long"):
+				types[name] = "double"
+			default:
+				types[name] = "string"
+			}
+		}
+	}
+
+	attrs := make([]graphAttribute, 0, len(types))
+	for name, typ := range types {
+		attrs = append(attrs, graphAttribute{name: name, typ: typ})
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].name < attrs[j].name })
+	return attrs
+}
+
+func attributeType(v any) string {
+	switch v.(type) {
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "long"
+	case float32, float64:
+		return "double"
+	case bool:
+		return "boolean"
+	}
+	return "string"
+}
+
+// attributeValue formats v, encoding lists and maps as JSON.
+func attributeValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, bool:
+		return fmt.Sprint(v)
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+type graphMLDocument struct {
+	XMLName xml.Name     `xml:"graphml"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Keys    []graphMLKey `xml:"key"`
+	Graph   graphMLGraph `xml:"graph"`
+}
+
+type graphMLKey struct {
+	ID   string `xml:"id,attr"`
+	For  string `xml:"for,attr"`
+	Name string `xml:"attr.name,attr"`
+	Type string `xml:"attr.type,attr"`
+}
+
+type graphMLGraph struct {
+	ID          string        `xml:"id,attr"`
+	EdgeDefault string        `xml:"edgedefault,attr"`
+	Nodes       []graphMLNode `xml:"node"`
+	Edges       []graphMLEdge `xml:"edge"`
+}
+
+type graphMLNode struct {
+	ID   string        `xml:"id,attr"`
+	Data []graphMLData `xml:"data"`
+}
+
+type graphMLEdge struct {
+	ID     string        `xml:"id,attr"`
+	Source string        `xml:"source,attr"`
+	Target string        `xml:"target,attr"`
+	Data   []graphMLData `xml:"data"`
+}
+
+type graphMLData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type gexfDocument struct {
+	XMLName xml.Name  `xml:"gexf"`
+	Xmlns   string    `xml:"xmlns,attr"`
+	Version string    `xml:"version,attr"`
+	Graph   gexfGraph `xml:"graph"`
+}
+
+type gexfGraph struct {
+	DefaultEdgeType string           `xml:"defaultedgetype,attr"`
+	Mode            string           `xml:"mode,attr"`
+	Attributes      []gexfAttributes `xml:"attributes"`
+	Nodes           []gexfNode       `xml:"nodes>node"`
+	Edges           []gexfEdge       `xml:"edges>edge"`
+}
+
+type gexfAttributes struct {
+	Class      string          `xml:"class,attr"`
+	Attributes []gexfAttribute `xml:"attribute"`
+}
+
+type gexfAttribute struct {
+	ID    string `xml:"id,attr"`
+	Title string `xml:"title,attr"`
+	Type  string `xml:"type,attr"`
+}
+
+type gexfNode struct {
+	ID     string      `xml:"id,attr"`
+	Label  string      `xml:"label,attr"`
+	Values []gexfValue `xml:"attvalues>attvalue"`
+}
+
+type gexfEdge struct {
+	ID     string      `xml:"id,attr"`
+	Source string      `xml:"source,attr"`
+	Target string      `xml:"target,attr"`
+	Label  string      `xml:"label,attr,omitempty"`
+	Weight string      `xml:"weight,attr,omitempty"`
+	Values []gexfValue `xml:"attvalues>attvalue"`
+}
+
+type gexfValue struct {
+	For   string `xml:"for,attr"`
+	Value string `xml:"value,attr"`
+}
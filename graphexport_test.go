@@ -0,0 +1,113 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+)
+
+func TestWriteGraphML(t *testing.T) {
+	g := NewGraph()
+	g.Add(graphReport())
+
+	var buf bytes.Buffer
+	if err := WriteGraphML(&buf, g); err != nil {
+		t.Fatalf("WriteGraphML() = %v", err)
+	}
+	var doc graphMLDocument
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+
+	keys := make(map[string]graphMLKey)
+	for _, key := range doc.Keys {
+		keys[key.ID] = key
+		keys[key.For+":"+key.Name] = key
+	}
+	for _, name := range []string{"node:package", "node:repository", "node:folder", "node:receiver", "node:label", "edge:type", "edge:count"} {
+		if _, ok := keys[name]; !ok {
+			t.Errorf("no %s key in %+v", name, doc.Keys)
+		}
+	}
+	if typ := keys["edge:cpu_ns"].Type; typ != "long" {
+		t.Errorf("cpu_ns key type = %q; want long", typ)
+	}
+
+	if len(doc.Graph.Nodes) != 3 || len(doc.Graph.Edges) != 3 {
+		t.Fatalf("GraphML has %d nodes and %d edges; want 3 and 3", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+	for _, node := range doc.Graph.Nodes {
+		for _, data := range node.Data {
+			if keys[data.Key].Name == "label" && node.ID == "Function:github.com/acme/app/server.(*Server).handle" && data.Value != "Server.handle" {
+				t.Errorf("handle label = %q; want Server.handle", data.Value)
+			}
+		}
+	}
+	var weighted bool
+	for _, edge := range doc.Graph.Edges {
+		for _, data := range edge.Data {
+			if keys[data.Key].Name == "cpu_ns" && data.Value == "10" {
+				weighted = true
+			}
+		}
+	}
+	if !weighted {
+		t.Errorf("no edge with cpu_ns 10 in %+v", doc.Graph.Edges)
+	}
+}
+
+func TestWriteGEXF(t *testing.T) {
+	g := NewGraph()
+	g.Add(graphReport())
+
+	var buf bytes.Buffer
+	if err := WriteGEXF(&buf, g, GEXFOptions{Weight: "cpu_ns"}); err != nil {
+		t.Fatalf("WriteGEXF() = %v", err)
+	}
+	var doc gexfDocument
+	if err := xml.Unmarshal(buf.Bytes(), &doc); err != nil {
+		t.Fatalf("invalid XML: %v\n%s", err, buf.String())
+	}
+
+	if len(doc.Graph.Attributes) != 2 || doc.Graph.Attributes[0].Class != "node" {
+		t.Fatalf("attributes = %+v; want node and edge attributes", doc.Graph.Attributes)
+	}
+	titles := make(map[string]bool)
+	for _, attr := range doc.Graph.Attributes[0].Attributes {
+		titles[attr.Title] = true
+	}
+	for _, title := range []string{"package", "repositoryName", "folderName", "receiver", "self_cpu_ns"} {
+		if !titles[title] {
+			t.Errorf("no %s node attribute in %+v", title, doc.Graph.Attributes[0])
+		}
+	}
+
+	if len(doc.Graph.Nodes) != 3 || len(doc.Graph.Edges) != 3 {
+		t.Fatalf("GEXF has %d nodes and %d edges; want 3 and 3", len(doc.Graph.Nodes), len(doc.Graph.Edges))
+	}
+	for _, edge := range doc.Graph.Edges {
+		want := ""
+		if edge.Label == "CALLS" {
+			want = "10"
+		}
+		if edge.Weight != want {
+			t.Errorf("%s edge weight = %q; want %q", edge.Label, edge.Weight, want)
+		}
+	}
+}
+
+func TestGraphAttributes(t *testing.T) {
+	attrs := graphAttributes([]exportedElement{
+		{values: map[string]any{"a": int64(1), "b": int64(1), "c": "x"}},
+		{values: map[string]any{"a": 1.5, "b": "y", "c": "z"}},
+	})
+	want := []graphAttribute{{"a", "double"}, {"b", "string"}, {"c", "string"}}
+	if len(attrs) != len(want) {
+		t.Fatalf("graphAttributes() = %v; want %v", attrs, want)
+	}
+	for i := range want {
+		if attrs[i] != want[i] {
+			t.Errorf("graphAttributes()[%d] = %v; want %v", i, attrs[i], want[i])
+		}
+	}
+}
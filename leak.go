@@ -0,0 +1,200 @@
+package stacktracetograph
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LeakDetectorOptions configures a LeakDetector. Zero values select the defaults.
+type LeakDetectorOptions struct {
+	// Window is the number of snapshots over which growth is measured. Default 5.
+	Window int
+	// MinSnapshots is the number of snapshots a group must appear in before
+	// it can be suspected. Default 3.
+	MinSnapshots int
+	// MinGrowth is the increase in goroutines across the window above which
+	// a group that never shrank is suspected. Default 10.
+	MinGrowth int
+}
+
+// LeakSuspect is a group of goroutines whose count kept growing across
+// snapshots.
+type LeakSuspect struct {
+	Signature string
+	State     string
+	Count     int // goroutines in the last snapshot
+	Growth    int // increase across the window
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Stack     []ParsedStackEntry
+	Spawns    []Spawn
+}
+
+// LeakDetector tracks the goroutine groups of successive snapshots and
+// suspects the ones that keep growing of leaking.
+type LeakDetector struct {
+	opts LeakDetectorOptions
+
+	mu       sync.Mutex
+	history  map[string]*groupHistory
+	suspects map[string]LeakSuspect
+}
+
+// groupHistory is the count of a goroutine group in the last snapshots.
+type groupHistory struct {
+	counts    []int
+	firstSeen time.Time
+}
+
+// NewLeakDetector creates a LeakDetector.
+func NewLeakDetector(opts LeakDetectorOptions) *LeakDetector {
+	if opts.Window <= 1 {
+		opts.Window = 5
+	}
+	if opts.MinSnapshots <= 1 {
+		opts.MinSnapshots = 3
+	}
+	opts.MinSnapshots = min(opts.MinSnapshots, opts.Window)
+	if opts.MinGrowth <= 0 {
+		opts.MinGrowth = 10
+	}
+	return &LeakDetector{
+		opts:     opts,
+		history:  make(map[string]*groupHistory),
+		suspects: make(map[string]LeakSuspect),
+	}
+}
+
+// Observe records a snapshot and returns the groups suspected of leaking in
+// it. Groups missing from the snapshot are forgotten, and no longer suspected.
+func (d *LeakDetector) Observe(snapshot GoroutineSnapshot) []LeakSuspect {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	seen := make(map[string]bool, len(snapshot.Groups))
+	var suspects []LeakSuspect
+	for _, group := range snapshot.Groups {
+		key := group.Signature + "\n" + group.State
+		seen[key] = true
+
+		h, ok := d.history[key]
+		if !ok {
+			h = &groupHistory{firstSeen: snapshot.Time}
+			d.history[key] = h
+		}
+		h.counts = append(h.counts, group.Count)
+		if len(h.counts) > d.opts.Window {
+			h.counts = h.counts[1:]
+		}
+
+		growth, growing := d.growth(h.counts)
+		if !growing {
+			delete(d.suspects, key)
+			continue
+		}
+		suspect := LeakSuspect{
+			Signature: group.Signature,
+			State:     group.State,
+			Count:     group.Count,
+			Growth:    growth,
+			FirstSeen: h.firstSeen,
+			LastSeen:  snapshot.Time,
+			Stack:     group.Stack,
+			Spawns:    group.Spawns,
+		}
+		d.suspects[key] = suspect
+		suspects = append(suspects, suspect)
+	}
+
+	for key := range d.history {
+		if !seen[key] {
+			delete(d.history, key)
+			delete(d.suspects, key)
+		}
+	}
+	return suspects
+}
+
+// growth returns the increase across counts, and whether it is large enough
+// to suspect a leak from a group that never shrank.
+func (d *LeakDetector) growth(counts []int) (int, bool) {
+	if len(counts) < d.opts.MinSnapshots {
+		return 0, false
+	}
+	for i := 1; i < len(counts); i++ {
+		if counts[i] < counts[i-1] {
+			return 0, false
+		}
+	}
+	growth := counts[len(counts)-1] - counts[0]
+	return growth, growth >= d.opts.MinGrowth
+}
+
+// Suspects returns the groups currently suspected of leaking, largest first.
+func (d *LeakDetector) Suspects() []LeakSuspect {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	suspects := make([]LeakSuspect, 0, len(d.suspects))
+	for _, suspect := range d.suspects {
+		suspects = append(suspects, suspect)
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		if suspects[i].Count != suspects[j].Count {
+			return suspects[i].Count > suspects[j].Count
+		}
+		return suspects[i].Signature < suspects[j].Signature
+	})
+	return suspects
+}
+
+// LeakSuspects returns the goroutine groups suspected of leaking by the
+// detector enabled with WithLeakDetection, or nil if it is not enabled.
+func (s *StackToGraph) LeakSuspects() []LeakSuspect {
+	if s.leaks == nil {
+		return nil
+	}
+	return s.leaks.Suspects()
+}
+
+// reportLeak writes a LeakSuspect node linked to the function that spawned
+// the leaking goroutines, or to their entry function if the spawn site is
+// unknown.
+func (s *StackToGraph) reportLeak(ctx context.Context, suspect LeakSuspect) error {
+	stack := suspect.Stack
+	if len(suspect.Spawns) > 0 {
+		spawn := suspect.Spawns[0]
+		stack = spawn.CreatorStack
+		if len(stack) == 0 {
+			stack = []ParsedStackEntry{spawn.Creator}
+		}
+	}
+	stack = s.filterFrames(append([]ParsedStackEntry(nil), stack...))
+	if len(stack) == 0 {
+		return nil
+	}
+
+	attachment := Attachment{
+		Label:        "LeakSuspect",
+		Relationship: "LEAKS",
+		Key: map[string]interface{}{
+			"signature": suspect.Signature,
+			"state":     suspect.State,
+		},
+		Properties: map[string]interface{}{
+			"count":     suspect.Count,
+			"growth":    suspect.Growth,
+			"firstSeen": suspect.FirstSeen.UTC().Format(time.RFC3339),
+			"lastSeen":  suspect.LastSeen.UTC().Format(time.RFC3339),
+		},
+	}
+	if len(suspect.Spawns) == 0 {
+		// Link the entry function, the bottom of the goroutine stack
+		attachment.Frame = len(stack) - 1
+	}
+
+	report := Report{Stack: stack, Attachments: []Attachment{attachment}, Labels: s.labels, Time: suspect.LastSeen}
+	return s.submit(ctx, "", report)
+}
@@ -0,0 +1,89 @@
+package stacktracetograph
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// leakSnapshot returns a snapshot with one group per signature and count.
+func leakSnapshot(counts map[string]int) GoroutineSnapshot {
+	snapshot := GoroutineSnapshot{Time: time.Now()}
+	for signature, count := range counts {
+		snapshot.Groups = append(snapshot.Groups, GoroutineGroup{Signature: signature, State: "chan receive", Count: count})
+	}
+	return snapshot
+}
+
+func TestLeakDetector(t *testing.T) {
+	d := NewLeakDetector(LeakDetectorOptions{Window: 3, MinSnapshots: 3, MinGrowth: 5})
+
+	d.Observe(leakSnapshot(map[string]int{"leak": 1, "stable": 4, "shrinking": 9}))
+	d.Observe(leakSnapshot(map[string]int{"leak": 4, "stable": 4, "shrinking": 2}))
+	suspects := d.Observe(leakSnapshot(map[string]int{"leak": 8, "stable": 4, "shrinking": 20}))
+
+	if len(suspects) != 1 || suspects[0].Signature != "leak" || suspects[0].Growth != 7 || suspects[0].Count != 8 {
+		t.Fatalf("Observe() = %+v; want only the leak, grown by 7", suspects)
+	}
+	if got := d.Suspects(); len(got) != 1 || got[0].Signature != "leak" {
+		t.Errorf("Suspects() = %+v; want the leak", got)
+	}
+
+	// A group that shrinks is no longer suspected
+	d.Observe(leakSnapshot(map[string]int{"leak": 2}))
+	if got := d.Suspects(); len(got) != 0 {
+		t.Errorf("Suspects() after the group shrank = %+v; want none", got)
+	}
+}
+
+func TestLeakDetectorForgetsGroups(t *testing.T) {
+	d := NewLeakDetector(LeakDetectorOptions{Window: 2, MinSnapshots: 2, MinGrowth: 1})
+
+	d.Observe(leakSnapshot(map[string]int{"leak": 1}))
+	d.Observe(leakSnapshot(map[string]int{"leak": 2}))
+	d.Observe(leakSnapshot(map[string]int{}))
+	if len(d.history) != 0 || len(d.Suspects()) != 0 {
+		t.Errorf("detector still tracks groups missing from the last snapshot")
+	}
+}
+
+func TestWithLeakDetection(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	leak := func(n int) {
+		for i := 0; i < n; i++ {
+			go func() { <-release }()
+		}
+	}
+
+	sink := NewMemorySink()
+	s, err := New(WithSink(sink), WithLeakDetection(LeakDetectorOptions{Window: 3, MinSnapshots: 3, MinGrowth: 4}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		leak(2)
+		time.Sleep(20 * time.Millisecond)
+		if _, err := s.SnapshotAllGoroutines(context.Background()); err != nil {
+			t.Fatalf("SnapshotAllGoroutines() = %v", err)
+		}
+	}
+
+	suspects := s.LeakSuspects()
+	if len(suspects) == 0 {
+		t.Fatalf("LeakSuspects() found no leak")
+	}
+	for _, report := range sink.Reports() {
+		a := report.Attachments[0]
+		if a.Label != "LeakSuspect" {
+			continue
+		}
+		if a.Relationship != "LEAKS" || report.Stack[a.Frame].Function != "TestWithLeakDetection" {
+			t.Errorf("leak suspect %+v linked from %+v; want the spawn site in TestWithLeakDetection", a, report.Stack[a.Frame])
+		}
+		return
+	}
+	t.Errorf("no LeakSuspect was reported")
+}
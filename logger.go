@@ -0,0 +1,59 @@
+package stacktracetograph
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"strconv"
+)
+
+// WithLogger sends the diagnostics of the library, such as failed writes,
+// to logger instead of slog.Default(). A nil logger silences them. To
+// receive diagnostics in a callback, use a logger with a custom slog.Handler.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			logger = discardLogger
+		}
+		o.logger = logger
+	}
+}
+
+// discardLogger drops every record.
+var discardLogger = slog.New(discardHandler{})
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (d discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return d }
+func (d discardHandler) WithGroup(string) slog.Handler           { return d }
+
+// loggerOrDefault returns logger, or slog.Default() when it is nil so changes
+// to the default logger are followed.
+func loggerOrDefault(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// logAttrs returns the attributes identifying a report in diagnostics.
+func (s *StackToGraph) logAttrs(cacheKey string, report Report) []slog.Attr {
+	hash := stackSignature(report.Stack)
+	if cacheKey != "" {
+		hash = stackHash(cacheKey)
+	}
+	return []slog.Attr{
+		slog.String("stack_hash", hash),
+		slog.String("backend", fmt.Sprintf("%T", s.sink)),
+	}
+}
+
+// stackHash returns a short stable identifier of a stack.
+func stackHash(stack string) string {
+	h := fnv.New64a()
+	h.Write([]byte(stack))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
@@ -0,0 +1,58 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestWithLogger(t *testing.T) {
+	skipUninstrumented(t)
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&buf, nil))
+
+	s, err := New(WithSink(failingSink{}), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.ReportStacktrace()
+
+	output := buf.String()
+	for _, fragment := range []string{
+		"level=ERROR",
+		`msg="stack2graph: failed to write report"`,
+		"stack_hash=",
+		"backend=stacktracetograph.failingSink",
+		"error=unavailable",
+	} {
+		if !strings.Contains(output, fragment) {
+			t.Errorf("log output %q does not contain %q", output, fragment)
+		}
+	}
+}
+
+func TestWithLoggerNilSilences(t *testing.T) {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	defer slog.SetDefault(previous)
+
+	s, err := New(WithSink(failingSink{}), WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.ReportStacktrace()
+
+	if buf.Len() != 0 {
+		t.Errorf("silenced StackToGraph logged %q", buf.String())
+	}
+}
+
+func TestStackHash(t *testing.T) {
+	if stackHash("a") != stackHash("a") || stackHash("a") == stackHash("b") {
+		t.Errorf("stackHash() is not a stable identifier")
+	}
+}
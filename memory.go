@@ -0,0 +1,45 @@
+package stacktracetograph
+
+import (
+	"context"
+	"sync"
+)
+
+// MemorySink keeps reports in memory, for tests and for exporting the
+// collected stacks without a database.
+type MemorySink struct {
+	mu      sync.Mutex
+	reports []Report
+}
+
+// NewMemorySink returns an empty MemorySink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{}
+}
+
+// Write appends the report.
+func (m *MemorySink) Write(ctx context.Context, report Report) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = append(m.reports, report)
+	return nil
+}
+
+// Reports returns the reports written so far, in order.
+func (m *MemorySink) Reports() []Report {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Report(nil), m.reports...)
+}
+
+// Reset removes all reports.
+func (m *MemorySink) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reports = nil
+}
+
+// Close does nothing; the reports remain available.
+func (m *MemorySink) Close() error {
+	return nil
+}
@@ -0,0 +1,15 @@
+package stacktracetograph
+
+import (
+	"context"
+	"testing"
+)
+
+func TestMemorySinkReset(t *testing.T) {
+	sink := NewMemorySink()
+	sink.Write(context.Background(), Report{})
+	sink.Reset()
+	if len(sink.Reports()) != 0 {
+		t.Errorf("Reports() after Reset() = %d reports; want none", len(sink.Reports()))
+	}
+}
@@ -0,0 +1,172 @@
+package stacktracetograph
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics is a snapshot of the counters describing the health and cost of
+// reporting.
+type Metrics struct {
+	StacksCaptured int64 // stacks captured and parsed, including those already reported
+	CacheHits      int64 // stacks skipped because they were already reported
+	StacksWritten  int64 // reports written to the sink
+	WriteErrors    int64 // failed writes, including writes refused by an open circuit
+	DroppedReports int64 // reports dropped because the async queue was full
+	QueueDepth     int   // reports waiting for a background worker
+
+	Sampling SamplingStats
+
+	WriteLatency   Histogram // seconds spent writing a report
+	FramesPerStack Histogram // frames in each reported stack, after filtering
+}
+
+// Histogram is a snapshot of a cumulative histogram. Counts[i] is the number
+// of observations less than or equal to Bounds[i]; Count includes the
+// observations above the last bound.
+type Histogram struct {
+	Bounds []float64
+	Counts []uint64
+	Count  uint64
+	Sum    float64
+}
+
+var (
+	writeLatencyBounds   = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	framesPerStackBounds = []float64{5, 10, 15, 20, 30, 40, 50, 75, 100, 150, 200}
+)
+
+const maxHistogramBounds = 16
+
+// metrics holds the counters of a StackToGraph. Its zero value is ready to use.
+type metrics struct {
+	stacksCaptured atomic.Int64
+	cacheHits      atomic.Int64
+	stacksWritten  atomic.Int64
+	writeErrors    atomic.Int64
+	dropped        atomic.Int64
+
+	writeLatency   histogram
+	framesPerStack histogram
+}
+
+// histogram counts observations in buckets whose bounds are kept by the caller.
+type histogram struct {
+	buckets [maxHistogramBounds]atomic.Uint64 // non-cumulative
+	count   atomic.Uint64
+	sumBits atomic.Uint64
+}
+
+func (h *histogram) observe(bounds []float64, v float64) {
+	for i, bound := range bounds {
+		if v <= bound {
+			h.buckets[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	for {
+		old := h.sumBits.Load()
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if h.sumBits.CompareAndSwap(old, sum) {
+			return
+		}
+	}
+}
+
+func (h *histogram) snapshot(bounds []float64) Histogram {
+	snapshot := Histogram{
+		Bounds: bounds,
+		Counts: make([]uint64, len(bounds)),
+		Count:  h.count.Load(),
+		Sum:    math.Float64frombits(h.sumBits.Load()),
+	}
+	var cumulative uint64
+	for i := range bounds {
+		cumulative += h.buckets[i].Load()
+		snapshot.Counts[i] = cumulative
+	}
+	return snapshot
+}
+
+// observeWrite records the outcome of writing a report.
+func (m *metrics) observeWrite(started time.Time, err error) {
+	m.writeLatency.observe(writeLatencyBounds, time.Since(started).Seconds())
+	if err != nil {
+		m.writeErrors.Add(1)
+	} else {
+		m.stacksWritten.Add(1)
+	}
+}
+
+// Metrics returns the current values of the reporting metrics.
+func (s *StackToGraph) Metrics() Metrics {
+	return Metrics{
+		StacksCaptured: s.metrics.stacksCaptured.Load(),
+		CacheHits:      s.metrics.cacheHits.Load(),
+		StacksWritten:  s.metrics.stacksWritten.Load(),
+		WriteErrors:    s.metrics.writeErrors.Load(),
+		DroppedReports: s.metrics.dropped.Load(),
+		QueueDepth:     len(s.queue),
+		Sampling:       s.SamplingStats(),
+		WriteLatency:   s.metrics.writeLatency.snapshot(writeLatencyBounds),
+		FramesPerStack: s.metrics.framesPerStack.snapshot(framesPerStackBounds),
+	}
+}
+
+// PublishExpvar publishes the metrics under name in expvar, served as JSON
+// at /debug/vars. Like expvar.Publish, it panics if name is already used.
+func (s *StackToGraph) PublishExpvar(name string) {
+	expvar.Publish(name, expvar.Func(func() any {
+		return s.Metrics()
+	}))
+}
+
+// MetricsHandler returns an http.Handler serving the metrics in the
+// Prometheus text exposition format, for scraping without depending on the
+// Prometheus client library.
+func (s *StackToGraph) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.Metrics().writePrometheus(w)
+	})
+}
+
+func (m Metrics) writePrometheus(w io.Writer) {
+	b := bufio.NewWriter(w)
+	defer b.Flush()
+
+	counter := func(name, help string, value int64) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	gauge := func(name, help string, value int) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+	}
+	histogram := func(name, help string, h Histogram) {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+		for i, bound := range h.Bounds {
+			fmt.Fprintf(b, "%s_bucket{le=%q} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), h.Counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+		fmt.Fprintf(b, "%s_sum %s\n%s_count %d\n", name, strconv.FormatFloat(h.Sum, 'g', -1, 64), name, h.Count)
+	}
+
+	counter("stack2graph_stacks_captured_total", "Stacks captured and parsed.", m.StacksCaptured)
+	counter("stack2graph_cache_hits_total", "Stacks skipped because they were already reported.", m.CacheHits)
+	counter("stack2graph_stacks_written_total", "Reports written to the sink.", m.StacksWritten)
+	counter("stack2graph_write_errors_total", "Reports that failed to be written.", m.WriteErrors)
+	counter("stack2graph_reports_dropped_total", "Reports dropped because the async queue was full.", m.DroppedReports)
+	counter("stack2graph_sampled_out_total", "Reports dropped by the sampling rate.", m.Sampling.SampledOut)
+	counter("stack2graph_rate_limited_total", "Reports dropped by the per-call-site rate limit.", m.Sampling.RateLimited)
+	counter("stack2graph_budget_exceeded_total", "Reports dropped by the stack or byte budget.", m.Sampling.BudgetExceeded)
+	gauge("stack2graph_queue_depth", "Reports waiting for a background worker.", m.QueueDepth)
+	histogram("stack2graph_write_duration_seconds", "Time spent writing a report to the sink.", m.WriteLatency)
+	histogram("stack2graph_frames_per_stack", "Frames in each reported stack.", m.FramesPerStack)
+}
@@ -0,0 +1,78 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// failingSink fails every write.
+type failingSink struct{}
+
+func (failingSink) Write(ctx context.Context, report Report) error { return errors.New("unavailable") }
+func (failingSink) Close() error                                   { return nil }
+
+func TestMetrics(t *testing.T) {
+	skipUninstrumented(t)
+	s := NewStackToGraphWithSink(NewMemorySink())
+	defer s.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := s.ReportStacktrace(); err != nil {
+			t.Fatalf("ReportStacktrace() = %v", err)
+		}
+	}
+
+	m := s.Metrics()
+	if m.StacksCaptured != 2 || m.CacheHits != 1 || m.StacksWritten != 1 || m.WriteErrors != 0 {
+		t.Errorf("Metrics() = %+v; want 2 stacks captured, 1 cache hit and 1 stack written", m)
+	}
+	if m.WriteLatency.Count != 1 || m.FramesPerStack.Count != 1 || m.FramesPerStack.Sum == 0 {
+		t.Errorf("histograms = %+v, %+v; want one observation each", m.WriteLatency, m.FramesPerStack)
+	}
+
+	failing := NewStackToGraphWithSink(failingSink{})
+	defer failing.Close()
+	failing.ReportStacktrace()
+	if m := failing.Metrics(); m.WriteErrors != 1 || m.StacksWritten != 0 {
+		t.Errorf("Metrics() after a failed write = %+v; want 1 write error", m)
+	}
+}
+
+func TestHistogramSnapshot(t *testing.T) {
+	var h histogram
+	bounds := []float64{1, 10}
+	for _, v := range []float64{0.5, 1, 5, 50} {
+		h.observe(bounds, v)
+	}
+
+	snapshot := h.snapshot(bounds)
+	if snapshot.Counts[0] != 2 || snapshot.Counts[1] != 3 || snapshot.Count != 4 || snapshot.Sum != 56.5 {
+		t.Errorf("snapshot() = %+v; want cumulative counts [2 3], count 4 and sum 56.5", snapshot)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	skipUninstrumented(t)
+	s := NewStackToGraphWithSink(NewMemorySink())
+	defer s.Close()
+	s.ReportStacktrace()
+
+	recorder := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE stack2graph_stacks_captured_total counter",
+		"stack2graph_stacks_written_total 1",
+		"stack2graph_queue_depth 0",
+		`stack2graph_write_duration_seconds_bucket{le="+Inf"} 1`,
+		"stack2graph_frames_per_stack_count 1",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("metrics output does not contain %q:\n%s", line, body)
+		}
+	}
+}
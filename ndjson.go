@@ -0,0 +1,214 @@
+package stacktracetograph
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// JSONSchemaVersion is the version of the JSON form of reports and graphs.
+// It is written with every NDJSON report and graph document, and readers
+// reject documents of newer versions.
+const JSONSchemaVersion = 1
+
+// ndjsonRecord is a line of an NDJSON file.
+type ndjsonRecord struct {
+	Version int     `json:"version"`
+	Report  *Report `json:"report"`
+}
+
+// graphDocument is the JSON form of a Graph.
+type graphDocument struct {
+	Version       int                 `json:"version"`
+	Nodes         []GraphNode         `json:"nodes"`
+	Relationships []GraphRelationship `json:"relationships"`
+}
+
+// checkSchemaVersion returns an error for documents this package cannot read.
+func checkSchemaVersion(version int) error {
+	if version < 1 || version > JSONSchemaVersion {
+		return fmt.Errorf("unsupported schema version %d", version)
+	}
+	return nil
+}
+
+// MarshalJSON encodes the graph with the schema version.
+func (g *Graph) MarshalJSON() ([]byte, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	doc := graphDocument{
+		Version:       JSONSchemaVersion,
+		Nodes:         g.Nodes,
+		Relationships: g.Relationships,
+	}
+	if doc.Nodes == nil {
+		doc.Nodes = []GraphNode{}
+	}
+	if doc.Relationships == nil {
+		doc.Relationships = []GraphRelationship{}
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes a graph encoded by MarshalJSON. Reports can be added
+// to the decoded graph.
+func (g *Graph) UnmarshalJSON(data []byte) error {
+	var doc graphDocument
+	if err := unmarshalNumbers(data, &doc); err != nil {
+		return err
+	}
+	for _, node := range doc.Nodes {
+		restoreNumbers(node.Properties)
+	}
+	for _, rel := range doc.Relationships {
+		restoreNumbers(rel.Properties)
+	}
+	if err := checkSchemaVersion(doc.Version); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.Nodes, g.Relationships = doc.Nodes, doc.Relationships
+	g.nodes, g.relationships = nil, nil
+	return nil
+}
+
+// NDJSONSink writes reports as newline delimited JSON, one report per line,
+// to stream them to other services or replay them later with ReplayNDJSON.
+type NDJSONSink struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+}
+
+// NewNDJSONSink returns a sink writing reports to w.
+func NewNDJSONSink(w io.Writer) *NDJSONSink {
+	return &NDJSONSink{w: bufio.NewWriter(w)}
+}
+
+// NewNDJSONFileSink returns a sink appending reports to the file at path,
+// which is created if needed.
+func NewNDJSONFileSink(path string) (*NDJSONSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open NDJSON file: %w", err)
+	}
+	return &NDJSONSink{w: bufio.NewWriter(f), closer: f}, nil
+}
+
+// Write writes the report as a line, flushed so readers see whole reports.
+func (n *NDJSONSink) Write(ctx context.Context, report Report) error {
+	line, err := json.Marshal(ndjsonRecord{Version: JSONSchemaVersion, Report: &report})
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.w.Write(line)
+	n.w.WriteByte('\n')
+	return n.w.Flush()
+}
+
+// Close flushes the sink and closes its file.
+func (n *NDJSONSink) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	err := n.w.Flush()
+	if n.closer != nil {
+		err = errors.Join(err, n.closer.Close())
+		n.closer = nil
+	}
+	return err
+}
+
+// ReplayNDJSONFile replays the reports of the NDJSON file at path. See
+// ReplayNDJSON.
+func ReplayNDJSONFile(ctx context.Context, sink Sink, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ReplayNDJSON(ctx, sink, f)
+}
+
+// ReplayNDJSON reads reports written by an NDJSONSink and writes them to
+// sink in order. It returns the number of reports written.
+func ReplayNDJSON(ctx context.Context, sink Sink, r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	written := 0
+	for {
+		var record ndjsonRecord
+		err := dec.Decode(&record)
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, fmt.Errorf("failed to read report %d: %w", written+1, err)
+		}
+		if err := checkSchemaVersion(record.Version); err != nil {
+			return written, fmt.Errorf("failed to read report %d: %w", written+1, err)
+		}
+		if record.Report == nil {
+			return written, fmt.Errorf("failed to read report %d: no report", written+1)
+		}
+		record.Report.restoreNumbers()
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		if err := sink.Write(ctx, *record.Report); err != nil {
+			return written, err
+		}
+		written++
+	}
+}
+
+// unmarshalNumbers decodes data like json.Unmarshal, but keeps numbers
+// decoded into interface values as json.Number for restoreNumbers.
+func unmarshalNumbers(data []byte, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+// restoreNumbers converts the numbers of the attachment keys and properties,
+// decoded as json.Number, back to int64, so they are written as integers
+// rather than floats like before they were encoded.
+func (r *Report) restoreNumbers() {
+	for _, a := range r.Attachments {
+		restoreNumbers(a.Key)
+		restoreNumbers(a.Properties)
+	}
+}
+
+// restoreNumbers converts the json.Number values of v, in place for maps and
+// lists, to int64, or to float64 for numbers that are not integers.
+func restoreNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for k, item := range v {
+			v[k] = restoreNumbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = restoreNumbers(item)
+		}
+	}
+	return v
+}
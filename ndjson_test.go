@@ -0,0 +1,84 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNDJSONReplay(t *testing.T) {
+	report := graphReport()
+	report.Time = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	report.Goroutine = 7
+	report.Duration = time.Millisecond
+	report.Attachments[0].Properties = map[string]any{"count": int64(3), "ratio": 0.5, "codes": []any{int64(400)}}
+
+	var buf bytes.Buffer
+	sink := NewNDJSONSink(&buf)
+	for i := 0; i < 2; i++ {
+		if err := sink.Write(context.Background(), report); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], `{"version":1,"report":{"stack":[{"function":"parse",`) {
+		t.Fatalf("NDJSON = %s", buf.String())
+	}
+
+	memory := NewMemorySink()
+	written, err := ReplayNDJSON(context.Background(), memory, &buf)
+	if err != nil || written != 2 {
+		t.Fatalf("ReplayNDJSON() = %d, %v; want 2 reports", written, err)
+	}
+	replayed := memory.Reports()[1]
+	if !reflect.DeepEqual(replayed, report) {
+		t.Errorf("replayed report = %+v; want %+v", replayed, report)
+	}
+}
+
+func TestNDJSONReplayErrors(t *testing.T) {
+	for _, input := range []string{
+		`{"version":2,"report":{"stack":[]}}`,
+		`{"report":{"stack":[]}}`,
+		`{"version":1}`,
+		`{"version":1,"report":`,
+	} {
+		written, err := ReplayNDJSON(context.Background(), NewMemorySink(), strings.NewReader(`{"version":1,"report":{"stack":[]}}`+"\n"+input))
+		if err == nil || written != 1 {
+			t.Errorf("ReplayNDJSON(%s) = %d, %v; want an error after 1 report", input, written, err)
+		}
+	}
+}
+
+func TestNDJSONFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.ndjson")
+	for i := 0; i < 2; i++ {
+		sink, err := NewNDJSONFileSink(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Write(context.Background(), graphReport()); err != nil {
+			t.Fatal(err)
+		}
+		if err := sink.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	g := NewGraph()
+	if written, err := ReplayNDJSONFile(context.Background(), g, path); err != nil || written != 2 {
+		t.Fatalf("ReplayNDJSONFile() = %d, %v; want the 2 reports appended", written, err)
+	}
+	for _, rel := range g.Relationships {
+		if rel.Type == "CALLS" && rel.Properties["cpu_ns"] != int64(20) {
+			t.Errorf("CALLS = %+v; want the weights of both reports", rel)
+		}
+	}
+}
@@ -0,0 +1,408 @@
+package stacktracetograph
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j/config"
+)
+
+// Neo4jConfig configures the connection of a Neo4jSink.
+type Neo4jConfig struct {
+	// URI of the database, such as neo4j://localhost or neo4j+s://host for TLS.
+	URI string
+	// Database is the name of the database reports are written to. Default "neo4j".
+	Database string
+	// Username and Password select basic authentication, BearerToken
+	// bearer authentication. Without either, no authentication is used.
+	Username    string
+	Password    string
+	BearerToken string
+	// TLSConfig, if set, is used for encrypted connections.
+	TLSConfig *tls.Config
+	// ConnectTimeout bounds establishing a connection and the verification
+	// at startup. Default 5 seconds.
+	ConnectTimeout time.Duration
+	// WriteTimeout bounds each write, including the retries of the driver.
+	// Default 10 seconds.
+	WriteTimeout time.Duration
+	// SkipVerify skips verifying connectivity when the sink is created, for
+	// applications that must start while the database is unavailable.
+	SkipVerify bool
+	// SetupSchema creates the constraints and indexes of the graph model
+	// when the sink is created. See Neo4jSink.SetupSchema.
+	SetupSchema bool
+}
+
+// auth returns the authentication token selected by the configuration.
+func (c Neo4jConfig) auth() neo4j.AuthToken {
+	switch {
+	case c.BearerToken != "":
+		return neo4j.BearerAuth(c.BearerToken)
+	case c.Username != "":
+		return neo4j.BasicAuth(c.Username, c.Password, "")
+	default:
+		return neo4j.NoAuth()
+	}
+}
+
+// Neo4jSink writes reports to a Neo4j database.
+type Neo4jSink struct {
+	driver neo4j.DriverWithContext
+	cfg    Neo4jConfig
+}
+
+// NewNeo4jSink connects to the Neo4j database at uri with basic
+// authentication. Like NewStackToGraph, it does not verify that the
+// database is reachable.
+func NewNeo4jSink(uri, username, password string) (*Neo4jSink, error) {
+	return NewNeo4jSinkWithConfig(context.Background(), Neo4jConfig{
+		URI:        uri,
+		Username:   username,
+		Password:   password,
+		SkipVerify: true,
+	})
+}
+
+// NewNeo4jSinkWithConfig connects to the Neo4j database described by cfg
+// and, unless cfg.SkipVerify is set, verifies that it is reachable.
+func NewNeo4jSinkWithConfig(ctx context.Context, cfg Neo4jConfig) (*Neo4jSink, error) {
+	if cfg.Database == "" {
+		cfg.Database = "neo4j"
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 5 * time.Second
+	}
+	if cfg.WriteTimeout <= 0 {
+		cfg.WriteTimeout = 10 * time.Second
+	}
+
+	driver, err := neo4j.NewDriverWithContext(cfg.URI, cfg.auth(), func(c *config.Config) {
+		c.SocketConnectTimeout = cfg.ConnectTimeout
+		c.ConnectionAcquisitionTimeout = cfg.ConnectTimeout
+		c.MaxTransactionRetryTime = cfg.WriteTimeout
+		if cfg.TLSConfig != nil {
+			c.TlsConfig = cfg.TLSConfig
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Neo4j driver: %w", err)
+	}
+
+	if !cfg.SkipVerify {
+		ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+		defer cancel()
+		if err := driver.VerifyConnectivity(ctx); err != nil {
+			driver.Close(context.Background())
+			return nil, fmt.Errorf("failed to connect to Neo4j: %w", err)
+		}
+	}
+
+	sink := &Neo4jSink{
+		driver: driver,
+		cfg:    cfg,
+	}
+
+	if cfg.SetupSchema {
+		if err := sink.SetupSchema(ctx); err != nil {
+			driver.Close(context.Background())
+			return nil, err
+		}
+	}
+
+	return sink, nil
+}
+
+// Close closes the Neo4j driver.
+func (n *Neo4jSink) Close() error {
+	return n.driver.Close(context.Background())
+}
+
+// Write merges the functions of the report, the CALLS relationships between
+// them and its attachments in a single transaction.
+func (n *Neo4jSink) Write(ctx context.Context, report Report) error {
+	stackTraceData := report.Stack
+
+	var labels string
+	for _, label := range report.Labels {
+		labels += " SET f:" + cypherName(label)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.cfg.WriteTimeout)
+	defer cancel()
+
+	// Create a new session
+	session := n.driver.NewSession(ctx, neo4j.SessionConfig{
+		DatabaseName: n.cfg.Database,
+		AccessMode:   neo4j.AccessModeWrite,
+	})
+	defer session.Close(ctx)
+
+	// Execute a write transaction
+	_, err := neo4j.ExecuteWrite(ctx, session, func(tx neo4j.ManagedTransaction) (any, error) {
+		if report.ID != "" {
+			applied, err := markApplied(ctx, tx, report.ID)
+			if err != nil || applied {
+				return nil, err
+			}
+		}
+
+		nodeIDs, err := mergeStack(ctx, tx, stackTraceData, labels, report.Weights)
+		if err != nil {
+			return nil, err
+		}
+
+		// Link attached nodes (errors, log events, ...) to the frame that produced them
+		for _, a := range report.Attachments {
+			if a.Frame < 0 || a.Frame >= len(nodeIDs) {
+				continue
+			}
+			query, params := a.mergeQuery()
+			params["functionID"] = nodeIDs[a.Frame]
+			if _, err := tx.Run(ctx, query, params); err != nil {
+				return nil, err
+			}
+		}
+
+		// Link the functions starting goroutines to the entry functions of the goroutines
+		for _, spawn := range report.Spawns {
+			creatorStack := spawn.CreatorStack
+			if len(creatorStack) == 0 {
+				creatorStack = []ParsedStackEntry{spawn.Creator}
+			}
+			creatorIDs, err := mergeStack(ctx, tx, creatorStack, labels, nil)
+			if err != nil {
+				return nil, err
+			}
+			entryIDs, err := mergeStack(ctx, tx, []ParsedStackEntry{spawn.Entry}, labels, nil)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := tx.Run(ctx, `
+				MATCH (creator), (entry)
+				WHERE elementId(creator) = $creatorID AND elementId(entry) = $entryID
+				MERGE (creator)-[:SPAWNS]->(entry)
+			`, map[string]any{
+				"creatorID": creatorIDs[0],
+				"entryID":   entryIDs[0],
+			}); err != nil {
+				return nil, err
+			}
+		}
+
+		return nil, nil
+	})
+
+	if err != nil {
+		return fmt.Errorf("failed to execute write transaction: %w", err)
+	}
+
+	return nil
+}
+
+// appliedReportLabel is the label of the nodes recording the IDs of the
+// weighted reports written. See DeleteAppliedReports.
+const appliedReportLabel = "Stack2GraphAppliedReport"
+
+// DeleteAppliedReports deletes the records of the weighted reports applied
+// before the given time, and returns how many were deleted. Reports must no
+// longer be retried or replayed from a WAL once their record is deleted, or
+// their weights are added again, so before is typically a day or more ago.
+func (n *Neo4jSink) DeleteAppliedReports(ctx context.Context, before time.Time) (int64, error) {
+	session := n.driver.NewSession(ctx, neo4j.SessionConfig{
+		DatabaseName: n.cfg.Database,
+		AccessMode:   neo4j.AccessModeWrite,
+	})
+	defer session.Close(ctx)
+
+	deleted, err := neo4j.ExecuteWrite(ctx, session, func(tx neo4j.ManagedTransaction) (int64, error) {
+		result, err := tx.Run(ctx, "MATCH (w:"+appliedReportLabel+") WHERE w.appliedAt < $before DELETE w RETURN count(w)", map[string]any{"before": before})
+		if err != nil {
+			return 0, err
+		}
+		record, err := result.Single(ctx)
+		if err != nil {
+			return 0, err
+		}
+		count, _ := record.Values[0].(int64)
+		return count, nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete applied reports: %w", err)
+	}
+	return deleted, nil
+}
+
+// markApplied records in the transaction writing it that the report with
+// the given ID is applied, and reports whether it already was.
+func markApplied(ctx context.Context, tx neo4j.ManagedTransaction, id string) (bool, error) {
+	result, err := tx.Run(ctx, "MATCH (w:"+appliedReportLabel+" {id: $id}) RETURN count(w) > 0", map[string]any{"id": id})
+	if err != nil {
+		return false, err
+	}
+	record, err := result.Single(ctx)
+	if err != nil {
+		return false, err
+	}
+	if applied, _ := record.Values[0].(bool); applied {
+		return true, nil
+	}
+	_, err = tx.Run(ctx, "CREATE (:"+appliedReportLabel+" {id: $id, appliedAt: datetime()})", map[string]any{"id": id})
+	return false, err
+}
+
+// mergeStack merges the functions of stack and the CALLS relationships
+// between them, adding weights to them, and returns the element IDs of the
+// function nodes.
+func mergeStack(ctx context.Context, tx neo4j.ManagedTransaction, stackTraceData []ParsedStackEntry, labels string, weights map[string]int64) ([]any, error) {
+	weightNames, weightParams := weightParameters(weights)
+	callsWeights := addWeights("c", "", weightNames)
+	selfWeights := addWeights("f", "self_", weightNames)
+
+	var previousNodeID any
+	nodeIDs := make([]any, len(stackTraceData))
+
+	// Reverse the stack to represent the top-down call flow
+	for i := len(stackTraceData) - 1; i >= 0; i-- {
+		frame := stackTraceData[i]
+
+		// Merge node for each function call to avoid duplicates
+		result, err := tx.Run(ctx, `
+	        	MERGE (f:Function {name: $name, package: $package})
+	    SET f.file = $file, f.line = $line, f.function = $function, f.receiver = $receiver, f.packageName = $packageName, f.repository = $repository, f.repositoryOrganization = $repositoryOrganization, f.repositoryName = $repositoryName, f.folder = $folder, f.folderName = $folderName
+	    `+labels+`
+	    RETURN elementId(f) AS nodeID
+
+		`, map[string]any{
+			"name":                   frame.OriginalName,
+			"receiver":               frame.Receiver,
+			"function":               frame.Function,
+			"file":                   frame.File,
+			"line":                   frame.Line,
+			"package":                frame.Package,
+			"packageName":            frame.PackageName,
+			"repository":             frame.Repository,
+			"repositoryOrganization": frame.RepositoryOrganization,
+			"repositoryName":         frame.RepositoryName,
+			"folder":                 frame.Folder,
+			"folderName":             frame.FolderName,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		record, err := result.Single(ctx)
+		if err != nil {
+			return nil, err
+		}
+		currentNodeID := record.Values[0]
+		nodeIDs[i] = currentNodeID
+
+		// Create "CALLS" relationship from the previous node to the current node
+		if previousNodeID != nil {
+			_, err = tx.Run(ctx, `
+				MATCH (caller), (callee)
+				WHERE elementId(caller) = $callerID AND elementId(callee) = $calleeID
+				MERGE (caller)-[c:CALLS]->(callee)
+			`+callsWeights, withParams(map[string]any{
+				"callerID": previousNodeID,
+				"calleeID": currentNodeID,
+			}, weightParams))
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		previousNodeID = currentNodeID
+	}
+
+	// The top function is where the weighted samples were taken
+	if selfWeights != "" && len(nodeIDs) > 0 {
+		if _, err := tx.Run(ctx, `
+			MATCH (f) WHERE elementId(f) = $functionID
+		`+selfWeights, withParams(map[string]any{"functionID": nodeIDs[0]}, weightParams)); err != nil {
+			return nil, err
+		}
+	}
+
+	return nodeIDs, nil
+}
+
+// weightParameters returns the sorted names of weights and the parameters
+// $weight0, $weight1, ... holding their values.
+func weightParameters(weights map[string]int64) ([]string, map[string]any) {
+	names := make([]string, 0, len(weights))
+	for name := range weights {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make(map[string]any, len(names))
+	for i, name := range names {
+		params[fmt.Sprintf("weight%d", i)] = weights[name]
+	}
+	return names, params
+}
+
+// addWeights builds the SET clauses adding the weight parameters to the
+// properties of variable named after the weights with prefix.
+func addWeights(variable, prefix string, names []string) string {
+	var clauses string
+	for i, name := range names {
+		clauses += fmt.Sprintf(" SET %[1]s.%[2]s = coalesce(%[1]s.%[2]s, 0) + $weight%[3]d", variable, cypherName(prefix+name), i)
+	}
+	return clauses
+}
+
+// withParams returns params with extra added.
+func withParams(params, extra map[string]any) map[string]any {
+	for k, v := range extra {
+		params[k] = v
+	}
+	return params
+}
+
+// mergeQuery builds the Cypher statement merging the attached node and its
+// relationship from the function node identified by $functionID.
+func (a Attachment) mergeQuery() (string, map[string]interface{}) {
+	params := map[string]interface{}{
+		"properties": a.Properties,
+	}
+	if a.Properties == nil {
+		params["properties"] = map[string]interface{}{}
+	}
+
+	keys := make([]string, 0, len(a.Key))
+	for k := range a.Key {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var fields []string
+	for i, k := range keys {
+		param := fmt.Sprintf("key%d", i)
+		fields = append(fields, fmt.Sprintf("%s: $%s", cypherName(k), param))
+		params[param] = a.Key[k]
+	}
+
+	weightNames, weightParams := weightParameters(a.Weights)
+
+	query := fmt.Sprintf(`
+		MATCH (f) WHERE elementId(f) = $functionID
+		MERGE (a:%s {%s})
+		SET a += $properties
+		MERGE (f)-[r:%s]->(a)%s
+	`, cypherName(a.Label), strings.Join(fields, ", "), cypherName(a.Relationship), addWeights("r", "", weightNames))
+
+	return query, withParams(params, weightParams)
+}
+
+// cypherName quotes a label, relationship type or property name for use in a Cypher statement.
+func cypherName(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
@@ -0,0 +1,95 @@
+package stacktracetograph
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNeo4jConfigAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      Neo4jConfig
+		expected string
+	}{
+		{"none", Neo4jConfig{}, "none"},
+		{"basic", Neo4jConfig{Username: "neo4j", Password: "secret"}, "basic"},
+		{"bearer", Neo4jConfig{Username: "neo4j", BearerToken: "token"}, "bearer"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if scheme := test.cfg.auth().Tokens["scheme"]; scheme != test.expected {
+				t.Errorf("auth() scheme = %v; want %q", scheme, test.expected)
+			}
+		})
+	}
+}
+
+func TestNewNeo4jSinkWithConfigVerifiesConnectivity(t *testing.T) {
+	cfg := Neo4jConfig{URI: "neo4j://127.0.0.1:1", ConnectTimeout: time.Second}
+
+	if _, err := NewNeo4jSinkWithConfig(context.Background(), cfg); err == nil {
+		t.Errorf("NewNeo4jSinkWithConfig succeeded without a reachable database")
+	}
+
+	cfg.SkipVerify = true
+	sink, err := NewNeo4jSinkWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("NewNeo4jSinkWithConfig with SkipVerify: %v", err)
+	}
+	defer sink.Close()
+	if sink.cfg.Database != "neo4j" || sink.cfg.WriteTimeout != 10*time.Second {
+		t.Errorf("defaults not applied: %+v", sink.cfg)
+	}
+}
+
+func TestNewStackToGraphConnectsLazily(t *testing.T) {
+	s, err := NewStackToGraph("neo4j://127.0.0.1:1", "neo4j", "password")
+	if err != nil {
+		t.Fatalf("NewStackToGraph without a reachable database: %v", err)
+	}
+	s.Close()
+
+	sink, err := NewNeo4jSink("neo4j://127.0.0.1:1", "neo4j", "password")
+	if err != nil {
+		t.Fatalf("NewNeo4jSink without a reachable database: %v", err)
+	}
+	sink.Close()
+}
+
+func TestAttachmentMergeQuery(t *testing.T) {
+	a := Attachment{
+		Label:        "Error",
+		Relationship: "ERROR_ORIGIN",
+		Key:          map[string]interface{}{"type": "*errors.errorString", "message": "boom"},
+	}
+
+	query, params := a.mergeQuery()
+	for _, fragment := range []string{
+		"elementId(f) = $functionID",
+		"MERGE (a:`Error` {`message`: $key0, `type`: $key1})",
+		"MERGE (f)-[r:`ERROR_ORIGIN`]->(a)",
+	} {
+		if !strings.Contains(query, fragment) {
+			t.Errorf("mergeQuery() = %q; want it to contain %q", query, fragment)
+		}
+	}
+	if params["key0"] != "boom" || params["key1"] != "*errors.errorString" || params["properties"] == nil {
+		t.Errorf("mergeQuery() params = %v", params)
+	}
+}
+
+func TestAttachmentMergeQueryWeights(t *testing.T) {
+	a := Attachment{
+		Label:        "BlockReason",
+		Relationship: "BLOCKS_ON",
+		Key:          map[string]interface{}{"reason": "chan receive"},
+		Weights:      map[string]int64{"blocked_ns": 10},
+	}
+	query, params := a.mergeQuery()
+	if !strings.Contains(query, "SET r.`blocked_ns` = coalesce(r.`blocked_ns`, 0) + $weight0") || params["weight0"] != int64(10) {
+		t.Errorf("mergeQuery() = %q, %v; want the weight added to the relationship", query, params)
+	}
+}
@@ -0,0 +1,394 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Option configures a StackToGraph created with New.
+type Option func(*options)
+
+type options struct {
+	sink      Sink
+	neo4j     *Neo4jConfig
+	retry     *RetryOptions
+	walDir    string
+	wal       WALOptions
+	filters   []FrameFilter
+	sampling  *Sampling
+	labels    []string
+	cacheSize int
+	queueSize int
+	workers   int
+	disabled  bool
+	logger    *slog.Logger
+
+	goroutineSnapshots time.Duration
+	leakDetection      *LeakDetectorOptions
+	reportDuplicates   bool
+}
+
+// FrameFilter reports whether a frame is kept in reported stacks.
+type FrameFilter func(frame ParsedStackEntry) bool
+
+// ExcludePackages returns a FrameFilter dropping the frames of packages
+// starting with any of the given prefixes, such as "runtime" or "net/http".
+func ExcludePackages(prefixes ...string) FrameFilter {
+	return func(frame ParsedStackEntry) bool {
+		for _, prefix := range prefixes {
+			if frame.Package == prefix || strings.HasPrefix(frame.Package, prefix+"/") {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// WithSink writes reports to sink.
+func WithSink(sink Sink) Option {
+	return func(o *options) {
+		o.sink = sink
+		o.neo4j = nil
+	}
+}
+
+// WithNeo4j writes reports to the Neo4j database described by cfg.
+func WithNeo4j(cfg Neo4jConfig) Option {
+	return func(o *options) {
+		o.neo4j = &cfg
+		o.sink = nil
+	}
+}
+
+// WithRetry retries failed writes and suspends writing while the backend
+// keeps failing. Retries block the goroutine writing the report, so combine
+// it with WithAsync to keep them out of the instrumented code. See RetrySink.
+func WithRetry(opts RetryOptions) Option {
+	return func(o *options) {
+		o.retry = &opts
+	}
+}
+
+// WithWAL buffers reports in dir while the backend is unavailable. See WALSink.
+func WithWAL(dir string, opts WALOptions) Option {
+	return func(o *options) {
+		o.walDir = dir
+		o.wal = opts
+	}
+}
+
+// WithFilter drops the frames for which filter returns false from reported stacks.
+func WithFilter(filter FrameFilter) Option {
+	return func(o *options) {
+		o.filters = append(o.filters, filter)
+	}
+}
+
+// WithSampling limits how often stacks are captured. See Sampling.
+func WithSampling(sampling Sampling) Option {
+	return func(o *options) {
+		o.sampling = &sampling
+	}
+}
+
+// WithLabels adds labels to every Function node written, for example to
+// tell apart the services sharing a database.
+func WithLabels(labels ...string) Option {
+	return func(o *options) {
+		o.labels = append(o.labels, labels...)
+	}
+}
+
+// WithCacheSize bounds the number of reported stacks remembered to skip
+// duplicates, evicting the least recently reported ones. Zero, the
+// default, remembers every stack.
+func WithCacheSize(size int) Option {
+	return func(o *options) {
+		o.cacheSize = size
+	}
+}
+
+// WithDeduplication turns off skipping the stacks already reported when
+// enabled is false, so every report is written with its time and
+// goroutine, for example to export a timeline with WriteChromeTrace.
+// Deduplication is on by default.
+func WithDeduplication(enabled bool) Option {
+	return func(o *options) {
+		o.reportDuplicates = !enabled
+	}
+}
+
+// WithAsync writes reports from workers background goroutines, so
+// reporting only captures and parses the stack. Reports are dropped when
+// queueSize reports are already waiting.
+func WithAsync(queueSize, workers int) Option {
+	return func(o *options) {
+		o.queueSize = queueSize
+		o.workers = workers
+	}
+}
+
+// WithEnabled turns reporting on or off. A disabled StackToGraph does not
+// capture or write anything until enabled with SetEnabled. Without a sink,
+// it writes reports nowhere once enabled.
+func WithEnabled(enabled bool) Option {
+	return func(o *options) {
+		o.disabled = !enabled
+	}
+}
+
+// WithGoroutineSnapshots reports a snapshot of all goroutines every
+// interval until the StackToGraph is closed. See SnapshotAllGoroutines.
+func WithGoroutineSnapshots(interval time.Duration) Option {
+	return func(o *options) {
+		o.goroutineSnapshots = interval
+	}
+}
+
+// WithLeakDetection feeds goroutine snapshots to a LeakDetector and reports
+// the groups it suspects as LeakSuspect nodes. Use it with
+// WithGoroutineSnapshots, or call SnapshotAllGoroutines periodically.
+func WithLeakDetection(opts LeakDetectorOptions) Option {
+	return func(o *options) {
+		o.leakDetection = &opts
+	}
+}
+
+// New creates a StackToGraph configured by opts. A sink must be configured
+// with WithSink or WithNeo4j unless reporting is disabled.
+func New(opts ...Option) (*StackToGraph, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	sink := o.sink
+	switch {
+	case sink != nil:
+	case o.neo4j != nil:
+		cfg := *o.neo4j
+		// The WAL keeps the reports until the database is reachable
+		if o.walDir != "" {
+			cfg.SkipVerify = true
+		}
+		neo4jSink, err := NewNeo4jSinkWithConfig(context.Background(), cfg)
+		if err != nil {
+			return nil, err
+		}
+		sink = neo4jSink
+	case o.disabled:
+		sink = discardSink{}
+	default:
+		return nil, errors.New("no sink configured, use WithSink or WithNeo4j")
+	}
+
+	if o.retry != nil {
+		sink = NewRetrySink(sink, *o.retry)
+	}
+	if o.walDir != "" {
+		if o.wal.Logger == nil {
+			o.wal.Logger = o.logger
+		}
+		walSink, err := NewWALSink(o.walDir, sink, o.wal)
+		if err != nil {
+			sink.Close()
+			return nil, err
+		}
+		sink = walSink
+	}
+
+	s := &StackToGraph{
+		sink:    sink,
+		filters: o.filters,
+		labels:  o.labels,
+		cache:   newReportedCache(o.cacheSize),
+		logger:  o.logger,
+
+		reportDuplicates: o.reportDuplicates,
+	}
+	s.disabled.Store(o.disabled)
+	if o.sampling != nil {
+		s.sampler = newSampler(*o.sampling, nil)
+	}
+	if o.queueSize > 0 {
+		s.startWorkers(o.queueSize, o.workers)
+	}
+	if o.leakDetection != nil {
+		s.leaks = NewLeakDetector(*o.leakDetection)
+	}
+	if o.goroutineSnapshots > 0 {
+		s.stopSnapshots = make(chan struct{})
+		s.snapshotter.Add(1)
+		go s.snapshotGoroutinesEvery(o.goroutineSnapshots, s.stopSnapshots, &s.snapshotter)
+	}
+
+	return s, nil
+}
+
+// Environment variables read by FromEnv.
+const (
+	EnvEnabled         = "STACK2GRAPH_ENABLED"           // true or false; defaults to whether STACK2GRAPH_URI is set
+	EnvURI             = "STACK2GRAPH_URI"               // Neo4j URI
+	EnvDatabase        = "STACK2GRAPH_DATABASE"          // Neo4j database name
+	EnvUsername        = "STACK2GRAPH_USERNAME"          // basic authentication
+	EnvPassword        = "STACK2GRAPH_PASSWORD"          // basic authentication
+	EnvBearerToken     = "STACK2GRAPH_BEARER_TOKEN"      // bearer authentication
+	EnvSetupSchema     = "STACK2GRAPH_SETUP_SCHEMA"      // true to create constraints and indexes on startup
+	EnvSampleRate      = "STACK2GRAPH_SAMPLE_RATE"       // Sampling.Rate, greater than 0 and at most 1
+	EnvCallSiteRate    = "STACK2GRAPH_CALL_SITE_RATE"    // Sampling.CallSiteRate
+	EnvStacksPerSecond = "STACK2GRAPH_STACKS_PER_SECOND" // Sampling.StacksPerSecond
+	EnvBytesPerSecond  = "STACK2GRAPH_BYTES_PER_SECOND"  // Sampling.BytesPerSecond
+	EnvLabels          = "STACK2GRAPH_LABELS"            // comma-separated labels of Function nodes
+	EnvCacheSize       = "STACK2GRAPH_CACHE_SIZE"        // WithCacheSize
+	EnvAsyncQueueSize  = "STACK2GRAPH_ASYNC_QUEUE_SIZE"  // WithAsync queue size
+	EnvAsyncWorkers    = "STACK2GRAPH_ASYNC_WORKERS"     // WithAsync workers, default 1
+	EnvRetry           = "STACK2GRAPH_RETRY"             // true to retry failed writes with the default RetryOptions
+	EnvWALDir          = "STACK2GRAPH_WAL_DIR"           // directory buffering reports while Neo4j is unavailable
+)
+
+// FromEnv creates a StackToGraph configured by the STACK2GRAPH_*
+// environment variables, followed by opts. When reporting is disabled, it
+// returns a StackToGraph that does nothing, so the same binary can run
+// with and without a graph database.
+func FromEnv(opts ...Option) (*StackToGraph, error) {
+	envOpts, err := EnvOptions()
+	if err != nil {
+		return nil, err
+	}
+	return New(append(envOpts, opts...)...)
+}
+
+// EnvOptions returns the options described by the STACK2GRAPH_*
+// environment variables.
+func EnvOptions() ([]Option, error) {
+	var p envParser
+
+	uri := os.Getenv(EnvURI)
+	enabled := p.bool(EnvEnabled, uri != "")
+	if !enabled {
+		return []Option{WithEnabled(false)}, p.err
+	}
+	if uri == "" {
+		return nil, fmt.Errorf("%s is required when %s is true", EnvURI, EnvEnabled)
+	}
+
+	opts := []Option{WithNeo4j(Neo4jConfig{
+		URI:         uri,
+		Database:    os.Getenv(EnvDatabase),
+		Username:    os.Getenv(EnvUsername),
+		Password:    os.Getenv(EnvPassword),
+		BearerToken: os.Getenv(EnvBearerToken),
+		SetupSchema: p.bool(EnvSetupSchema, false),
+	})}
+
+	sampling := Sampling{
+		Rate:            p.rate(EnvSampleRate),
+		CallSiteRate:    p.float(EnvCallSiteRate),
+		StacksPerSecond: p.float(EnvStacksPerSecond),
+		BytesPerSecond:  p.float(EnvBytesPerSecond),
+	}
+	if sampling != (Sampling{}) {
+		opts = append(opts, WithSampling(sampling))
+	}
+
+	if labels := os.Getenv(EnvLabels); labels != "" {
+		for _, label := range strings.Split(labels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				opts = append(opts, WithLabels(label))
+			}
+		}
+	}
+	if size := p.int(EnvCacheSize); size > 0 {
+		opts = append(opts, WithCacheSize(size))
+	}
+	if queueSize := p.int(EnvAsyncQueueSize); queueSize > 0 {
+		opts = append(opts, WithAsync(queueSize, p.int(EnvAsyncWorkers)))
+	}
+	if p.bool(EnvRetry, false) {
+		opts = append(opts, WithRetry(RetryOptions{}))
+	}
+	if dir := os.Getenv(EnvWALDir); dir != "" {
+		opts = append(opts, WithWAL(dir, WALOptions{}))
+	}
+
+	return opts, p.err
+}
+
+// envParser parses environment variables, keeping the first error.
+type envParser struct {
+	err error
+}
+
+func (p *envParser) lookup(name string) (string, bool) {
+	value, ok := os.LookupEnv(name)
+	value = strings.TrimSpace(value)
+	return value, ok && value != ""
+}
+
+func (p *envParser) fail(name, value string, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("invalid %s %q: %w", name, value, err)
+	}
+}
+
+func (p *envParser) bool(name string, fallback bool) bool {
+	value, ok := p.lookup(name)
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		p.fail(name, value, err)
+		return fallback
+	}
+	return b
+}
+
+func (p *envParser) float(name string) float64 {
+	value, ok := p.lookup(name)
+	if !ok {
+		return 0
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		p.fail(name, value, err)
+		return 0
+	}
+	return f
+}
+
+// rate parses a probability. Zero is rejected rather than read as no
+// sampling, which would capture every report.
+func (p *envParser) rate(name string) float64 {
+	f := p.float(name)
+	if value, ok := p.lookup(name); ok && p.err == nil && (f <= 0 || f > 1) {
+		p.fail(name, value, errors.New("must be greater than 0 and at most 1"))
+		return 0
+	}
+	return f
+}
+
+func (p *envParser) int(name string) int {
+	value, ok := p.lookup(name)
+	if !ok {
+		return 0
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		p.fail(name, value, err)
+		return 0
+	}
+	return i
+}
+
+// discardSink drops every report.
+type discardSink struct{}
+
+func (discardSink) Write(ctx context.Context, report Report) error { return nil }
+func (discardSink) Close() error                                   { return nil }
@@ -0,0 +1,148 @@
+package stacktracetograph
+
+import (
+	"testing"
+)
+
+func TestNewRequiresSink(t *testing.T) {
+	if _, err := New(); err == nil {
+		t.Errorf("New() without a sink succeeded")
+	}
+
+	s, err := New(WithEnabled(false))
+	if err != nil {
+		t.Fatalf("New(WithEnabled(false)): %v", err)
+	}
+	defer s.Close()
+	if s.allowCapture() {
+		t.Errorf("disabled StackToGraph allows capturing stacks")
+	}
+}
+
+func TestNewOptions(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s, err := New(
+		WithSink(sink),
+		WithFilter(ExcludePackages("runtime", "testing")),
+		WithLabels("ServiceA"),
+		WithAsync(10, 2),
+	)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if err := s.ReportStacktrace(); err != nil {
+		t.Fatalf("ReportStacktrace: %v", err)
+	}
+	s.Close()
+
+	reports := sink.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("sink received %d reports; want 1", len(reports))
+	}
+	report := reports[0]
+	if len(report.Labels) != 1 || report.Labels[0] != "ServiceA" {
+		t.Errorf("report labels = %q; want [ServiceA]", report.Labels)
+	}
+	if len(report.Stack) == 0 {
+		t.Fatalf("report has no frames")
+	}
+	for _, frame := range report.Stack {
+		if frame.Package == "runtime" || frame.Package == "testing" {
+			t.Errorf("frame of excluded package %s was reported", frame.Package)
+		}
+	}
+}
+
+func TestEnvOptions(t *testing.T) {
+	t.Run("disabled without URI", func(t *testing.T) {
+		t.Setenv(EnvURI, "")
+		s, err := FromEnv()
+		if err != nil {
+			t.Fatalf("FromEnv: %v", err)
+		}
+		defer s.Close()
+		if s.Enabled() {
+			t.Errorf("FromEnv() without %s is enabled", EnvURI)
+		}
+	})
+
+	t.Run("disabled explicitly", func(t *testing.T) {
+		t.Setenv(EnvURI, "neo4j://127.0.0.1:1")
+		t.Setenv(EnvEnabled, "false")
+		opts, err := EnvOptions()
+		if err != nil || len(opts) != 1 {
+			t.Errorf("EnvOptions() = %d options, %v; want a single option disabling reporting", len(opts), err)
+		}
+	})
+
+	t.Run("enabled without URI", func(t *testing.T) {
+		t.Setenv(EnvURI, "")
+		t.Setenv(EnvEnabled, "true")
+		if _, err := EnvOptions(); err == nil {
+			t.Errorf("EnvOptions() succeeded without %s", EnvURI)
+		}
+	})
+
+	t.Run("invalid value", func(t *testing.T) {
+		t.Setenv(EnvURI, "neo4j://127.0.0.1:1")
+		for _, rate := range []string{"often", "0", "-0.5", "1.5"} {
+			t.Setenv(EnvSampleRate, rate)
+			if _, err := EnvOptions(); err == nil {
+				t.Errorf("EnvOptions() succeeded with %s=%s", EnvSampleRate, rate)
+			}
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		t.Setenv(EnvURI, "neo4j://127.0.0.1:1")
+		t.Setenv(EnvSampleRate, "0.5")
+		t.Setenv(EnvLabels, "ServiceA, Production")
+		t.Setenv(EnvCacheSize, "100")
+		opts, err := EnvOptions()
+		if err != nil {
+			t.Fatalf("EnvOptions: %v", err)
+		}
+
+		o := &options{}
+		for _, opt := range opts {
+			opt(o)
+		}
+		if o.neo4j == nil || o.neo4j.URI != "neo4j://127.0.0.1:1" {
+			t.Errorf("Neo4j config = %+v", o.neo4j)
+		}
+		if o.sampling == nil || o.sampling.Rate != 0.5 {
+			t.Errorf("sampling = %+v; want a rate of 0.5", o.sampling)
+		}
+		if len(o.labels) != 2 || o.labels[0] != "ServiceA" || o.labels[1] != "Production" {
+			t.Errorf("labels = %q", o.labels)
+		}
+		if o.cacheSize != 100 {
+			t.Errorf("cacheSize = %d; want 100", o.cacheSize)
+		}
+	})
+}
+
+func TestReportedCache(t *testing.T) {
+	c := newReportedCache(2)
+	c.add("a", nil)
+	c.add("b", nil)
+	c.contains("a") // a is now more recent than b
+	c.add("c", nil)
+
+	if !c.contains("a") || c.contains("b") || !c.contains("c") {
+		t.Errorf("cache did not evict the least recently used key")
+	}
+	if c.len() != 2 {
+		t.Errorf("len() = %d; want 2", c.len())
+	}
+
+	unbounded := newReportedCache(0)
+	for _, key := range []string{"a", "b", "c"} {
+		unbounded.add(key, nil)
+	}
+	if unbounded.len() != 3 {
+		t.Errorf("unbounded cache len() = %d; want 3", unbounded.len())
+	}
+}
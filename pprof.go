@@ -0,0 +1,229 @@
+package stacktracetograph
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+)
+
+// ProfileImportOptions configures ImportProfile.
+type ProfileImportOptions struct {
+	// Labels are added to the Function nodes written.
+	Labels []string
+	// WeightPrefix is prepended to the weight names, for example "mutex_"
+	// to keep mutex contention apart from block contention, which use the
+	// same sample types.
+	WeightPrefix string
+	// Filter drops frames from the imported stacks, like WithFilter.
+	Filter FrameFilter
+}
+
+// profileWeights names the weights of the sample types of the profiles
+// written by the Go runtime. Other sample types are named type_unit.
+var profileWeights = map[string]string{
+	"samples/count":       "samples",
+	"cpu/nanoseconds":     "cpu_ns",
+	"alloc_objects/count": "alloc_objects",
+	"alloc_space/bytes":   "alloc_bytes",
+	"inuse_objects/count": "inuse_objects",
+	"inuse_space/bytes":   "inuse_bytes",
+	"goroutine/count":     "goroutines",
+	"contentions/count":   "contentions",
+	"delay/nanoseconds":   "contention_ns",
+}
+
+// ImportProfileFile imports the pprof profile stored at path. See ImportProfile.
+func ImportProfileFile(ctx context.Context, sink Sink, path string, opts ProfileImportOptions) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return ImportProfile(ctx, sink, f, opts)
+}
+
+// ImportProfile reads a pprof profile, such as a CPU, heap, goroutine,
+// block or mutex profile, and writes the stack of each distinct sample to
+// sink with the sample values as weights, for example cpu_ns or
+// alloc_bytes. Weights are added to the existing ones, so importing the
+// same profile twice counts it twice. It returns the number of stacks written.
+func ImportProfile(ctx context.Context, sink Sink, r io.Reader, opts ProfileImportOptions) (int, error) {
+	p, err := profile.Parse(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse profile: %w", err)
+	}
+
+	names := make([]string, len(p.SampleType))
+	for i, st := range p.SampleType {
+		name, ok := profileWeights[st.Type+"/"+st.Unit]
+		if !ok {
+			name = st.Type + "_" + st.Unit
+		}
+		names[i] = opts.WeightPrefix + name
+	}
+
+	// Samples differing only by their labels share a stack
+	type weightedStack struct {
+		stack   []ParsedStackEntry
+		weights map[string]int64
+	}
+	var stacks []*weightedStack
+	index := make(map[string]*weightedStack)
+	for _, sample := range p.Sample {
+		key := sampleKey(sample)
+		ws, ok := index[key]
+		if !ok {
+			ws = &weightedStack{stack: sampleStack(sample, opts.Filter), weights: make(map[string]int64)}
+			index[key] = ws
+			stacks = append(stacks, ws)
+		}
+		for i, value := range sample.Value {
+			ws.weights[names[i]] += value
+		}
+	}
+
+	written := 0
+	for _, ws := range stacks {
+		if len(ws.stack) == 0 {
+			continue
+		}
+		if err := sink.Write(ctx, Report{Stack: ws.stack, Labels: opts.Labels, Weights: ws.weights}); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// sampleKey identifies the stack of a sample.
+func sampleKey(sample *profile.Sample) string {
+	var b strings.Builder
+	for _, loc := range sample.Location {
+		fmt.Fprintf(&b, "%d,", loc.ID)
+	}
+	return b.String()
+}
+
+// sampleStack returns the frames of a sample, top first, including the
+// functions inlined into each location.
+func sampleStack(sample *profile.Sample, filter FrameFilter) []ParsedStackEntry {
+	// Render the frames like runtime.Stack so they are parsed the same way
+	var b strings.Builder
+	for _, loc := range sample.Location {
+		for _, line := range loc.Line {
+			if line.Function == nil {
+				continue
+			}
+			fmt.Fprintf(&b, "%s(...)\n\t%s:%d\n", line.Function.Name, line.Function.Filename, line.Line)
+		}
+	}
+
+	return filterStack(parseStackTrace(b.String()), filter)
+}
+
+// filterStack removes the frames rejected by filter, if any.
+func filterStack(stack []ParsedStackEntry, filter FrameFilter) []ParsedStackEntry {
+	if filter == nil {
+		return stack
+	}
+	kept := stack[:0]
+	for _, frame := range stack {
+		if filter(frame) {
+			kept = append(kept, frame)
+		}
+	}
+	return kept
+}
+
+// StackCount is a reported stack with the number of times it was reported.
+type StackCount struct {
+	Stack []ParsedStackEntry
+	Count int64
+}
+
+// StackCounts returns the stacks written so far with the number of times
+// each was reported, including the duplicates skipped. Stacks evicted from
+// the cache bounded by WithCacheSize are not included.
+func (s *StackToGraph) StackCounts() []StackCount {
+	s.Lock()
+	defer s.Unlock()
+	if s.cache == nil {
+		return nil
+	}
+	return s.cache.counts()
+}
+
+// WriteProfile writes the reported stacks as a pprof profile, with the
+// number of times each was reported as sample value. See WriteProfile.
+func (s *StackToGraph) WriteProfile(w io.Writer) error {
+	return WriteProfile(w, s.StackCounts())
+}
+
+// WriteProfile writes stacks as a gzipped profile.proto readable by go tool
+// pprof, with a "hits" sample value holding their counts.
+func WriteProfile(w io.Writer, stacks []StackCount) error {
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "hits", Unit: "count"}},
+		PeriodType: &profile.ValueType{Type: "hits", Unit: "count"},
+		Period:     1,
+		TimeNanos:  time.Now().UnixNano(),
+	}
+
+	functions := make(map[string]*profile.Function)
+	locations := make(map[string]*profile.Location)
+	for _, sc := range stacks {
+		sample := &profile.Sample{Value: []int64{sc.Count}}
+		for _, frame := range sc.Stack {
+			name := frameSymbol(frame)
+			fn, ok := functions[name+"\n"+frame.File]
+			if !ok {
+				fn = &profile.Function{
+					ID:         uint64(len(p.Function) + 1),
+					Name:       name,
+					SystemName: name,
+					Filename:   frame.File,
+				}
+				functions[name+"\n"+frame.File] = fn
+				p.Function = append(p.Function, fn)
+			}
+
+			line, _ := strconv.ParseInt(frame.Line, 10, 64)
+			locKey := fmt.Sprintf("%d:%d", fn.ID, line)
+			loc, ok := locations[locKey]
+			if !ok {
+				loc = &profile.Location{
+					ID:   uint64(len(p.Location) + 1),
+					Line: []profile.Line{{Function: fn, Line: line}},
+				}
+				locations[locKey] = loc
+				p.Location = append(p.Location, loc)
+			}
+			sample.Location = append(sample.Location, loc)
+		}
+		p.Sample = append(p.Sample, sample)
+	}
+
+	if err := p.CheckValid(); err != nil {
+		return fmt.Errorf("invalid profile: %w", err)
+	}
+	return p.Write(w)
+}
+
+// frameSymbol returns the symbol of the function of a frame, such as
+// github.com/x/y.(*T).Method.
+func frameSymbol(frame ParsedStackEntry) string {
+	name := frame.OriginalName
+	if name == "" {
+		name = frame.Function
+	}
+	if frame.Package == "" {
+		return name
+	}
+	return frame.Package + "." + name
+}
@@ -0,0 +1,158 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+func TestImportProfile(t *testing.T) {
+	handle := &profile.Function{ID: 1, Name: "github.com/acme/app/server.(*Server).handle", Filename: "/app/server/server.go"}
+	parse := &profile.Function{ID: 2, Name: "github.com/acme/app/server.parse", Filename: "/app/server/parse.go"}
+	encode := &profile.Function{ID: 3, Name: "encoding/json.Marshal", Filename: "/go/src/encoding/json/encode.go"}
+
+	// parse is inlined into handle
+	handleLoc := &profile.Location{ID: 1, Line: []profile.Line{{Function: parse, Line: 12}, {Function: handle, Line: 40}}}
+	encodeLoc := &profile.Location{ID: 2, Line: []profile.Line{{Function: encode, Line: 160}}}
+
+	p := &profile.Profile{
+		SampleType: []*profile.ValueType{{Type: "samples", Unit: "count"}, {Type: "cpu", Unit: "nanoseconds"}},
+		Sample: []*profile.Sample{
+			{Location: []*profile.Location{encodeLoc, handleLoc}, Value: []int64{2, 20}},
+			{Location: []*profile.Location{encodeLoc, handleLoc}, Value: []int64{1, 10}, Label: map[string][]string{"k": {"v"}}},
+			{Location: []*profile.Location{handleLoc}, Value: []int64{3, 30}},
+		},
+		Location: []*profile.Location{handleLoc, encodeLoc},
+		Function: []*profile.Function{handle, parse, encode},
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewMemorySink()
+	written, err := ImportProfile(context.Background(), sink, &buf, ProfileImportOptions{Labels: []string{"Profiled"}})
+	if err != nil {
+		t.Fatalf("ImportProfile() = %v", err)
+	}
+	reports := sink.Reports()
+	if written != 2 || len(reports) != 2 {
+		t.Fatalf("ImportProfile() wrote %d stacks (%d reports); want 2", written, len(reports))
+	}
+
+	report := reports[0]
+	var functions []string
+	for _, frame := range report.Stack {
+		functions = append(functions, frame.Function)
+	}
+	if strings.Join(functions, ",") != "Marshal,parse,handle" {
+		t.Errorf("stack = %v; want Marshal, parse and handle, top first", functions)
+	}
+	if report.Stack[2].Receiver != "Server" || report.Stack[2].Line != "40" {
+		t.Errorf("handle frame = %+v", report.Stack[2])
+	}
+	if report.Weights["cpu_ns"] != 30 || report.Weights["samples"] != 3 || report.Labels[0] != "Profiled" {
+		t.Errorf("report weights = %v, labels = %v; want the sum of both samples", report.Weights, report.Labels)
+	}
+}
+
+func TestImportGoroutineProfile(t *testing.T) {
+	var buf bytes.Buffer
+	if err := pprof.Lookup("goroutine").WriteTo(&buf, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := NewMemorySink()
+	opts := ProfileImportOptions{WeightPrefix: "test_", Filter: ExcludePackages("runtime")}
+	if _, err := ImportProfile(context.Background(), sink, &buf, opts); err != nil {
+		t.Fatalf("ImportProfile() = %v", err)
+	}
+
+	for _, report := range sink.Reports() {
+		if report.Weights["test_goroutines"] == 0 {
+			t.Errorf("report weights = %v; want test_goroutines", report.Weights)
+		}
+		for _, frame := range report.Stack {
+			if frame.Package == "runtime" {
+				t.Errorf("filtered frame %+v was imported", frame)
+			}
+		}
+		if report.Stack[0].Function == "TestImportGoroutineProfile" {
+			return
+		}
+	}
+	t.Errorf("the goroutine of the test is missing from the imported profile")
+}
+
+func TestAddWeights(t *testing.T) {
+	names, params := weightParameters(map[string]int64{"cpu_ns": 5, "samples": 1})
+	if len(names) != 2 || names[0] != "cpu_ns" || params["weight0"] != int64(5) || params["weight1"] != int64(1) {
+		t.Fatalf("weightParameters() = %v, %v", names, params)
+	}
+	if clauses := addWeights("f", "self_", names[:1]); clauses != " SET f.`self_cpu_ns` = coalesce(f.`self_cpu_ns`, 0) + $weight0" {
+		t.Errorf("addWeights() = %q", clauses)
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	skipUninstrumented(t)
+	s := NewStackToGraphWithSink(NewMemorySink())
+	defer s.Close()
+	for i := 0; i < 3; i++ {
+		s.ReportStacktrace()
+	}
+
+	var buf bytes.Buffer
+	if err := s.WriteProfile(&buf); err != nil {
+		t.Fatalf("WriteProfile() = %v", err)
+	}
+	p, err := profile.Parse(&buf)
+	if err != nil {
+		t.Fatalf("profile.Parse() = %v", err)
+	}
+
+	if len(p.Sample) != 1 || p.Sample[0].Value[0] != 3 {
+		t.Fatalf("profile samples = %v; want one stack reported 3 times", p.Sample)
+	}
+	var found bool
+	for _, loc := range p.Sample[0].Location {
+		if loc.Line[0].Function.Name == libraryPackage+".TestWriteProfile" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("profile does not contain the function of the test:\n%v", p)
+	}
+}
+
+func reportFromGoroutine(s *StackToGraph, wg *sync.WaitGroup) {
+	defer wg.Done()
+	s.ReportStacktrace()
+}
+
+func TestStackCountsAcrossGoroutines(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	// The traces differ by their goroutine header, the path is the same
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go reportFromGoroutine(s, &wg)
+		wg.Wait()
+	}
+
+	if len(sink.Reports()) != 1 {
+		t.Errorf("sink received %d reports; want the path written once", len(sink.Reports()))
+	}
+	if counts := s.StackCounts(); len(counts) != 1 || counts[0].Count != 5 {
+		t.Errorf("StackCounts() = %+v; want one stack reported 5 times", counts)
+	}
+}
@@ -0,0 +1,265 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// ErrCircuitOpen is returned by RetrySink while writes to the backend are
+// suspended after repeated failures.
+var ErrCircuitOpen = errors.New("stack2graph: circuit breaker is open, backend writes are suspended")
+
+// RetryOptions configures a RetrySink. Zero values select the defaults.
+type RetryOptions struct {
+	// MaxAttempts is the number of attempts per write, including the first. Default 3.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry, doubled for every
+	// following retry up to MaxBackoff. Defaults 50ms and 1s.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// FailureThreshold is the number of consecutive writes failing with
+	// transient errors that opens the circuit. Default 5.
+	FailureThreshold int
+	// OpenDuration is how long the circuit stays open before a single write
+	// is let through to probe the backend. Default 30s.
+	OpenDuration time.Duration
+	// Transient reports whether a failed write may succeed if retried.
+	// Defaults to IsTransientError.
+	Transient func(error) bool
+}
+
+// CircuitState is the state of the circuit breaker of a RetrySink.
+type CircuitState int
+
+const (
+	// CircuitClosed lets every write through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen rejects writes with ErrCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen lets a single probing write through.
+	CircuitHalfOpen
+)
+
+func (c CircuitState) String() string {
+	switch c {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// RetrySink retries failed writes to a backend sink with exponential
+// backoff, and stops attempting writes once the backend keeps failing so an
+// outage does not keep slowing down its writers. Retries block the writer,
+// so reporters use it with WithAsync to retry on the background workers
+// rather than in the instrumented code. Wrapping a RetrySink in a WALSink
+// buffers the reports rejected while the circuit is open.
+type RetrySink struct {
+	backend Sink
+	opts    RetryOptions
+	now     func() time.Time
+	sleep   func(context.Context, time.Duration) error
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int       // consecutive writes failed with transient errors
+	openedAt time.Time // when the circuit was last opened
+	probing  bool      // a probing write is in flight
+}
+
+// NewRetrySink wraps backend with retries and a circuit breaker.
+func NewRetrySink(backend Sink, opts RetryOptions) *RetrySink {
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 3
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 50 * time.Millisecond
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = time.Second
+	}
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = 5
+	}
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = 30 * time.Second
+	}
+	if opts.Transient == nil {
+		opts.Transient = IsTransientError
+	}
+
+	return &RetrySink{
+		backend: backend,
+		opts:    opts,
+		now:     time.Now,
+		sleep:   sleepContext,
+	}
+}
+
+// Write writes the report to the backend, retrying transient errors. It
+// returns ErrCircuitOpen without attempting the write while the circuit is
+// open. Writes abandoned because ctx is done do not count as failures.
+func (r *RetrySink) Write(ctx context.Context, report Report) error {
+	// A failed attempt may have been applied, the ID keeps retries from
+	// adding its weights again
+	report = report.withID()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	probe, ok := r.acquire()
+	if !ok {
+		return ErrCircuitOpen
+	}
+
+	backoff := r.opts.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err := r.backend.Write(ctx, report)
+		if err == nil {
+			r.succeeded()
+			return nil
+		}
+		// The caller gave up on the write, which says nothing of the backend
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			r.abandoned()
+			return ctxErr
+		}
+		if !r.opts.Transient(err) {
+			// The backend answered, the report itself is at fault and must
+			// not suspend the writes of other reports
+			r.succeeded()
+			return err
+		}
+		// A probe gets a single attempt so the circuit reopens quickly
+		if probe || attempt >= r.opts.MaxAttempts {
+			r.failed()
+			return err
+		}
+
+		// Full jitter spreads the retries of concurrent writers
+		delay := time.Duration(rand.Int64N(int64(backoff))) + 1
+		if err := r.sleep(ctx, delay); err != nil {
+			r.abandoned()
+			return err
+		}
+		backoff *= 2
+		if backoff > r.opts.MaxBackoff {
+			backoff = r.opts.MaxBackoff
+		}
+	}
+}
+
+// State returns the current state of the circuit breaker.
+func (r *RetrySink) State() CircuitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.state == CircuitOpen && r.now().Sub(r.openedAt) >= r.opts.OpenDuration {
+		return CircuitHalfOpen
+	}
+	return r.state
+}
+
+// Close closes the backend.
+func (r *RetrySink) Close() error {
+	return r.backend.Close()
+}
+
+// acquire reports whether a write may be attempted and whether it is the
+// probe of a half-open circuit.
+func (r *RetrySink) acquire() (probe bool, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.state {
+	case CircuitClosed:
+		return false, true
+	case CircuitOpen:
+		if r.now().Sub(r.openedAt) < r.opts.OpenDuration {
+			return false, false
+		}
+		r.state = CircuitHalfOpen
+	}
+
+	if r.probing {
+		return false, false
+	}
+	r.probing = true
+	return true, true
+}
+
+func (r *RetrySink) succeeded() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.state = CircuitClosed
+	r.failures = 0
+	r.probing = false
+}
+
+// abandoned ends a write given up by its caller, letting another write
+// probe the backend if it was the probe.
+func (r *RetrySink) abandoned() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.probing = false
+}
+
+func (r *RetrySink) failed() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+	if r.probing || r.failures >= r.opts.FailureThreshold {
+		r.state = CircuitOpen
+		r.openedAt = r.now()
+	}
+	r.probing = false
+}
+
+// IsTransientError reports whether err is likely caused by a temporary
+// condition, such as an unreachable or overloaded database, rather than by
+// the report itself.
+func IsTransientError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	if neo4j.IsRetryable(err) {
+		return true
+	}
+	var connectivityErr *neo4j.ConnectivityError
+	if errors.As(err, &connectivityErr) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,202 @@
+package stacktracetograph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakySink fails its writes with err while failures is positive.
+type flakySink struct {
+	err      error
+	failures int
+	attempts int
+}
+
+func (f *flakySink) Write(ctx context.Context, report Report) error {
+	f.attempts++
+	if f.failures > 0 {
+		f.failures--
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakySink) Close() error { return nil }
+
+// newTestRetrySink returns a RetrySink that does not sleep and whose clock
+// is advanced by the returned function.
+func newTestRetrySink(backend Sink, opts RetryOptions) (*RetrySink, func(time.Duration)) {
+	r := NewRetrySink(backend, opts)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+	r.sleep = func(context.Context, time.Duration) error { return nil }
+	return r, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRetrySinkRetriesTransientErrors(t *testing.T) {
+	ctx := context.Background()
+
+	backend := &flakySink{err: io.ErrUnexpectedEOF, failures: 2}
+	r, _ := newTestRetrySink(backend, RetryOptions{MaxAttempts: 3})
+	if err := r.Write(ctx, Report{}); err != nil {
+		t.Errorf("Write() = %v; want success on the third attempt", err)
+	}
+	if backend.attempts != 3 {
+		t.Errorf("backend attempts = %d; want 3", backend.attempts)
+	}
+
+	backend = &flakySink{err: errors.New("syntax error"), failures: 1}
+	r, _ = newTestRetrySink(backend, RetryOptions{MaxAttempts: 3})
+	if err := r.Write(ctx, Report{}); err == nil {
+		t.Errorf("Write() succeeded; want the permanent error")
+	}
+	if backend.attempts != 1 {
+		t.Errorf("backend attempts = %d; want a single attempt for a permanent error", backend.attempts)
+	}
+}
+
+func TestRetrySinkCircuitBreaker(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakySink{err: syscall.ECONNREFUSED, failures: 100}
+	r, advance := newTestRetrySink(backend, RetryOptions{MaxAttempts: 1, FailureThreshold: 3, OpenDuration: time.Minute})
+
+	for i := 0; i < 3; i++ {
+		if err := r.Write(ctx, Report{}); !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("Write %d = %v; want the backend error", i, err)
+		}
+	}
+	if r.State() != CircuitOpen {
+		t.Fatalf("State() = %v after %d failures; want open", r.State(), 3)
+	}
+	if err := r.Write(ctx, Report{}); err != ErrCircuitOpen || backend.attempts != 3 {
+		t.Errorf("Write() = %v with %d attempts; want ErrCircuitOpen without reaching the backend", err, backend.attempts)
+	}
+
+	// A failed probe reopens the circuit
+	advance(time.Minute)
+	if r.State() != CircuitHalfOpen {
+		t.Errorf("State() = %v after OpenDuration; want half-open", r.State())
+	}
+	if err := r.Write(ctx, Report{}); !errors.Is(err, syscall.ECONNREFUSED) || r.State() != CircuitOpen {
+		t.Errorf("failed probe: Write() = %v, State() = %v; want the backend error and an open circuit", err, r.State())
+	}
+
+	// A successful probe closes it
+	backend.failures = 0
+	advance(time.Minute)
+	if err := r.Write(ctx, Report{}); err != nil || r.State() != CircuitClosed {
+		t.Errorf("successful probe: Write() = %v, State() = %v; want success and a closed circuit", err, r.State())
+	}
+}
+
+func TestRetrySinkPermanentErrorsKeepCircuitClosed(t *testing.T) {
+	ctx := context.Background()
+	backend := &flakySink{err: errors.New("invalid property"), failures: 10}
+	r, _ := newTestRetrySink(backend, RetryOptions{FailureThreshold: 3})
+
+	for i := 0; i < 5; i++ {
+		if err := r.Write(ctx, Report{}); err == nil || err == ErrCircuitOpen {
+			t.Fatalf("Write %d = %v; want the backend error", i, err)
+		}
+	}
+	if r.State() != CircuitClosed || backend.attempts != 5 {
+		t.Errorf("State() = %v after %d permanent errors; want closed", r.State(), backend.attempts)
+	}
+}
+
+// cancelSink cancels the context of its writes, which then fail.
+type cancelSink struct {
+	cancel context.CancelFunc
+}
+
+func (c *cancelSink) Write(ctx context.Context, report Report) error {
+	c.cancel()
+	return syscall.ECONNRESET
+}
+
+func (c *cancelSink) Close() error { return nil }
+
+func TestRetrySinkCancelledWritesKeepCircuitClosed(t *testing.T) {
+	backend := &flakySink{err: syscall.ECONNREFUSED, failures: 10}
+	r, _ := newTestRetrySink(backend, RetryOptions{FailureThreshold: 1})
+
+	// Cancelled while waiting to retry
+	ctx, cancel := context.WithCancel(context.Background())
+	r.sleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	if err := r.Write(ctx, Report{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() = %v; want context.Canceled", err)
+	}
+	// Cancelled before the write
+	if err := r.Write(ctx, Report{}); !errors.Is(err, context.Canceled) || backend.attempts != 1 {
+		t.Errorf("Write() = %v with %d attempts; want context.Canceled without another attempt", err, backend.attempts)
+	}
+	// Cancelled during the write
+	ctx, cancel = context.WithCancel(context.Background())
+	r.backend = &cancelSink{cancel: cancel}
+	if err := r.Write(ctx, Report{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Write() = %v; want context.Canceled", err)
+	}
+
+	if r.State() != CircuitClosed {
+		t.Errorf("State() = %v after cancelled writes; want closed", r.State())
+	}
+}
+
+// idSink records the IDs of the reports it receives.
+type idSink struct {
+	flakySink
+	ids []string
+}
+
+func (s *idSink) Write(ctx context.Context, report Report) error {
+	s.ids = append(s.ids, report.ID)
+	return s.flakySink.Write(ctx, report)
+}
+
+func TestRetrySinkKeepsReportID(t *testing.T) {
+	ctx := context.Background()
+	backend := &idSink{flakySink: flakySink{err: io.ErrUnexpectedEOF, failures: 2}}
+	r, _ := newTestRetrySink(backend, RetryOptions{MaxAttempts: 3})
+
+	if err := r.Write(ctx, Report{Weights: map[string]int64{"cpu_ns": 1}}); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if len(backend.ids) != 3 || backend.ids[0] == "" || backend.ids[1] != backend.ids[0] || backend.ids[2] != backend.ids[0] {
+		t.Errorf("attempts had IDs %q; want the same ID for every attempt of a weighted report", backend.ids)
+	}
+
+	backend.ids = nil
+	if err := r.Write(ctx, Report{}); err != nil || backend.ids[0] != "" {
+		t.Errorf("Write() = %v with ID %q; want no ID without weights", err, backend.ids)
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("invalid input"), false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, true},
+		{fmt.Errorf("failed to execute write transaction: %w", io.EOF), true},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, true},
+		{syscall.ECONNRESET, true},
+	}
+
+	for _, test := range tests {
+		if result := IsTransientError(test.err); result != test.expected {
+			t.Errorf("IsTransientError(%v) = %v; want %v", test.err, result, test.expected)
+		}
+	}
+}
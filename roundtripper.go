@@ -0,0 +1,83 @@
+package stacktracetograph
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// RoundTripper is an http.RoundTripper that reports the call stack of each
+// outbound request, linking the function that made it to an
+// ExternalEndpoint node with a CALLS_EXTERNAL relationship.
+type RoundTripper struct {
+	next http.RoundTripper
+	s2g  *StackToGraph
+}
+
+// NewRoundTripper wraps next, or http.DefaultTransport if next is nil, with
+// a RoundTripper reporting to s. If s is nil, the instance of the request
+// context is used, see FromContext.
+func NewRoundTripper(next http.RoundTripper, s *StackToGraph) *RoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &RoundTripper{next: next, s2g: s}
+}
+
+// RoundTrip reports the request and executes it with the wrapped RoundTripper.
+func (rt *RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := rt.s2g
+	if s == nil {
+		s = FromContext(req.Context())
+	}
+	if s != nil && s.allowCapture("net/http") {
+		stack := captureStackTrace()
+		// Errors are already logged by reportStack and must not fail the request
+		_ = s.reportStack(req.Context(), stack, Attachment{
+			Label:        "ExternalEndpoint",
+			Relationship: "CALLS_EXTERNAL",
+			SkipPackages: []string{"net/http"},
+			Key: map[string]interface{}{
+				"host":   req.URL.Host,
+				"method": req.Method,
+				"path":   templatePath(req.URL.Path),
+			},
+		})
+	}
+
+	return rt.next.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the wrapped
+// RoundTripper, if it keeps any, so http.Client.CloseIdleConnections works.
+func (rt *RoundTripper) CloseIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	if c, ok := rt.next.(closeIdler); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+var (
+	uuidSegmentPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	hashSegmentPattern = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+	idSegmentPattern   = regexp.MustCompile(`^\d+$`)
+)
+
+// templatePath replaces the path segments that look like identifiers with
+// placeholders so requests to the same resource share an ExternalEndpoint node.
+func templatePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		switch {
+		case idSegmentPattern.MatchString(segment):
+			segments[i] = "{id}"
+		case uuidSegmentPattern.MatchString(segment):
+			segments[i] = "{uuid}"
+		case hashSegmentPattern.MatchString(segment):
+			segments[i] = "{hash}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
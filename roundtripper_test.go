@@ -0,0 +1,108 @@
+package stacktracetograph
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoundTripperForwardsRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Method+" "+r.URL.Path)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: NewRoundTripper(nil, nil)}
+	resp, err := client.Get(server.URL + "/users/42")
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if got, want := string(body), "GET /users/42"; got != want {
+		t.Errorf("response body = %q; want %q", got, want)
+	}
+}
+
+func TestRoundTripperReports(t *testing.T) {
+	skipUninstrumented(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+	req, err := http.NewRequestWithContext(NewContext(context.Background(), s), http.MethodPost, server.URL+"/v1/users/42/orders", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: NewRoundTripper(nil, nil)}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	resp.Body.Close()
+
+	reports := sink.Reports()
+	if len(reports) != 1 || len(reports[0].Attachments) != 1 {
+		t.Fatalf("sink received %+v; want one report with an ExternalEndpoint", reports)
+	}
+	report, a := reports[0], reports[0].Attachments[0]
+	host := strings.TrimPrefix(server.URL, "http://")
+	if a.Label != "ExternalEndpoint" || a.Relationship != "CALLS_EXTERNAL" ||
+		a.Key["host"] != host || a.Key["method"] != "POST" || a.Key["path"] != "/v1/users/{id}/orders" {
+		t.Errorf("attachment = %+v; want POST %s/v1/users/{id}/orders", a, host)
+	}
+	// The report is linked to the first frame outside net/http and this
+	// package, the caller of the test function here
+	if a.Frame < 1 || report.Stack[a.Frame-1].Function != "TestRoundTripperReports" || report.Stack[a.Frame].Package != "testing" {
+		t.Errorf("request linked to frame %d of %+v; want the caller of the test", a.Frame, report.Stack)
+	}
+}
+
+// idleTransport counts the calls to CloseIdleConnections.
+type idleTransport struct {
+	http.RoundTripper
+	closed int
+}
+
+func (t *idleTransport) CloseIdleConnections() {
+	t.closed++
+}
+
+func TestRoundTripperCloseIdleConnections(t *testing.T) {
+	transport := &idleTransport{RoundTripper: http.DefaultTransport}
+	client := &http.Client{Transport: NewRoundTripper(transport, nil)}
+	client.CloseIdleConnections()
+	if transport.closed != 1 {
+		t.Errorf("wrapped transport CloseIdleConnections called %d times; want 1", transport.closed)
+	}
+}
+
+func TestTemplatePath(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"", ""},
+		{"/", "/"},
+		{"/v1/users/42", "/v1/users/{id}"},
+		{"/v1/users/42/orders/7/", "/v1/users/{id}/orders/{id}/"},
+		{"/objects/123e4567-e89b-12d3-a456-426614174000", "/objects/{uuid}"},
+		{"/commits/9fceb02d0ae598e95dc970b74767f19372d61af8", "/commits/{hash}"},
+		{"/v2/accounts/me", "/v2/accounts/me"},
+	}
+
+	for _, test := range tests {
+		if result := templatePath(test.input); result != test.expected {
+			t.Errorf("templatePath(%q) = %q; want %q", test.input, result, test.expected)
+		}
+	}
+}
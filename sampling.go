@@ -0,0 +1,226 @@
+package stacktracetograph
+
+import (
+	"math/rand/v2"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sampling limits how often stacks are captured so reporting can stay
+// enabled in production. The zero value captures every report.
+type Sampling struct {
+	// Rate is the probability, between 0 and 1, that a report is captured.
+	// Zero captures every report.
+	Rate float64
+	// CallSiteRate is the number of reports per second allowed from a
+	// single call site, with bursts of up to CallSiteBurst reports.
+	// Zero disables the per-call-site limit.
+	CallSiteRate  float64
+	CallSiteBurst int
+	// StacksPerSecond and BytesPerSecond bound the stacks captured and the
+	// size of the stacks reported across all call sites. Zero means unlimited.
+	// Bursts of one second of the budget are allowed, and of at least one
+	// stack of the largest size captured, so rates below one stack per
+	// second still let stacks through.
+	StacksPerSecond float64
+	BytesPerSecond  float64
+}
+
+// SamplingStats counts the reports that were dropped by sampling.
+type SamplingStats struct {
+	SampledOut     int64 // dropped by Rate
+	RateLimited    int64 // dropped by CallSiteRate
+	BudgetExceeded int64 // dropped by StacksPerSecond or BytesPerSecond
+}
+
+// SetSampling configures sampling and rate limits for future reports.
+func (s *StackToGraph) SetSampling(cfg Sampling) {
+	s.Lock()
+	defer s.Unlock()
+	s.sampler = newSampler(cfg, s.sampler)
+}
+
+// SamplingStats returns the number of reports dropped by sampling so far.
+func (s *StackToGraph) SamplingStats() SamplingStats {
+	s.Lock()
+	sampler := s.sampler
+	s.Unlock()
+	if sampler == nil {
+		return SamplingStats{}
+	}
+	return SamplingStats{
+		SampledOut:     sampler.sampledOut.Load(),
+		RateLimited:    sampler.rateLimited.Load(),
+		BudgetExceeded: sampler.budgetExceeded.Load(),
+	}
+}
+
+// allowCapture reports whether a stack should be captured for the calling
+// code, identified by its first frame outside this package and skipPackages.
+func (s *StackToGraph) allowCapture(skipPackages ...string) bool {
+	if !instrumented || s.disabled.Load() {
+		return false
+	}
+	s.Lock()
+	sampler := s.sampler
+	s.Unlock()
+	if sampler == nil {
+		return true
+	}
+	return sampler.allowCapture(time.Now(), skipPackages)
+}
+
+// allowBytes reports whether a captured stack of the given size fits in the budget.
+func (s *StackToGraph) allowBytes(n int) bool {
+	s.Lock()
+	sampler := s.sampler
+	s.Unlock()
+	if sampler == nil {
+		return true
+	}
+	return sampler.allowBytes(time.Now(), n)
+}
+
+type sampler struct {
+	cfg Sampling
+
+	sync.Mutex
+	callSites map[uintptr]*tokenBucket
+	stacks    *tokenBucket
+	bytes     *tokenBucket
+
+	sampledOut     atomic.Int64
+	rateLimited    atomic.Int64
+	budgetExceeded atomic.Int64
+}
+
+// newSampler creates a sampler for cfg, keeping the counters of previous.
+func newSampler(cfg Sampling, previous *sampler) *sampler {
+	sp := &sampler{
+		cfg:       cfg,
+		callSites: make(map[uintptr]*tokenBucket),
+	}
+	if cfg.StacksPerSecond > 0 {
+		sp.stacks = newTokenBucket(cfg.StacksPerSecond, max(cfg.StacksPerSecond, 1))
+	}
+	if cfg.BytesPerSecond > 0 {
+		sp.bytes = newTokenBucket(cfg.BytesPerSecond, max(cfg.BytesPerSecond, maxStackBytes))
+	}
+	if previous != nil {
+		sp.sampledOut.Store(previous.sampledOut.Load())
+		sp.rateLimited.Store(previous.rateLimited.Load())
+		sp.budgetExceeded.Store(previous.budgetExceeded.Load())
+	}
+	return sp
+}
+
+func (sp *sampler) allowCapture(now time.Time, skipPackages []string) bool {
+	if sp.cfg.Rate > 0 && sp.cfg.Rate < 1 && rand.Float64() >= sp.cfg.Rate {
+		sp.sampledOut.Add(1)
+		return false
+	}
+
+	var site uintptr
+	if sp.cfg.CallSiteRate > 0 {
+		site = callSite(skipPackages)
+	}
+
+	sp.Lock()
+	defer sp.Unlock()
+
+	if sp.cfg.CallSiteRate > 0 {
+		bucket, ok := sp.callSites[site]
+		if !ok {
+			burst := float64(sp.cfg.CallSiteBurst)
+			if burst < 1 {
+				burst = 1
+			}
+			bucket = newTokenBucket(sp.cfg.CallSiteRate, burst)
+			sp.callSites[site] = bucket
+		}
+		if !bucket.take(now, 1) {
+			sp.rateLimited.Add(1)
+			return false
+		}
+	}
+
+	if sp.stacks != nil && !sp.stacks.take(now, 1) {
+		sp.budgetExceeded.Add(1)
+		return false
+	}
+	return true
+}
+
+func (sp *sampler) allowBytes(now time.Time, n int) bool {
+	if sp.bytes == nil {
+		return true
+	}
+	sp.Lock()
+	defer sp.Unlock()
+	if !sp.bytes.take(now, float64(n)) {
+		sp.budgetExceeded.Add(1)
+		return false
+	}
+	return true
+}
+
+// callSite returns the program counter of the first caller outside this
+// package and skipPackages.
+func callSite(skipPackages []string) uintptr {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(4, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := frames.Next()
+		pkg, _ := ParsePackageName(frame.Function)
+		if !skipPackage(pkg, skipPackages) {
+			return frame.PC
+		}
+		if !more {
+			return frame.PC
+		}
+	}
+}
+
+// skipPackage reports whether pkg is this package or one of skipPackages.
+func skipPackage(pkg string, skipPackages []string) bool {
+	if pkg == libraryPackage {
+		return true
+	}
+	for _, skip := range skipPackages {
+		if pkg == skip {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenBucket refills at rate tokens per second up to burst tokens.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst}
+}
+
+// take removes n tokens from the bucket if it holds enough of them.
+func (b *tokenBucket) take(now time.Time, n float64) bool {
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
@@ -0,0 +1,118 @@
+package stacktracetograph
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3)
+
+	for i := 0; i < 3; i++ {
+		if !b.take(now, 1) {
+			t.Fatalf("take %d within the burst was refused", i)
+		}
+	}
+	if b.take(now, 1) {
+		t.Errorf("take beyond the burst was allowed")
+	}
+	if !b.take(now.Add(500*time.Millisecond), 1) {
+		t.Errorf("take after refilling one token was refused")
+	}
+	if b.take(now.Add(500*time.Millisecond), 1) {
+		t.Errorf("take beyond the refilled tokens was allowed")
+	}
+	if !b.take(now.Add(time.Hour), 3) || b.take(now.Add(time.Hour), 1) {
+		t.Errorf("bucket refilled beyond its burst")
+	}
+}
+
+func TestSamplerRate(t *testing.T) {
+	sp := newSampler(Sampling{Rate: 0.25}, nil)
+
+	const reports = 10000
+	captured := 0
+	for i := 0; i < reports; i++ {
+		if sp.allowCapture(time.Now(), nil) {
+			captured++
+		}
+	}
+	if captured < reports/5 || captured > reports*3/10 {
+		t.Errorf("captured %d of %d reports; want about a quarter", captured, reports)
+	}
+	if got := sp.sampledOut.Load(); got != int64(reports-captured) {
+		t.Errorf("sampledOut = %d; want %d", got, reports-captured)
+	}
+}
+
+func TestSamplerLimits(t *testing.T) {
+	now := time.Now()
+
+	sp := newSampler(Sampling{CallSiteRate: 1, CallSiteBurst: 2}, nil)
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if sp.allowCapture(now, nil) {
+			allowed++
+		}
+	}
+	if allowed != 2 || sp.rateLimited.Load() != 3 {
+		t.Errorf("call site limit allowed %d and limited %d reports; want 2 and 3", allowed, sp.rateLimited.Load())
+	}
+
+	sp = newSampler(Sampling{StacksPerSecond: 1, BytesPerSecond: 100}, sp)
+	if !sp.allowCapture(now, nil) || sp.allowCapture(now, nil) {
+		t.Errorf("stacks budget did not allow exactly one stack")
+	}
+	if !sp.allowBytes(now, maxStackBytes) || sp.allowBytes(now, 80) {
+		t.Errorf("bytes budget did not allow exactly one stack")
+	}
+	if got := sp.budgetExceeded.Load(); got != 2 {
+		t.Errorf("budgetExceeded = %d; want 2", got)
+	}
+	if got := sp.rateLimited.Load(); got != 3 {
+		t.Errorf("rateLimited = %d after reconfiguring; want 3", got)
+	}
+}
+
+func TestSamplerBudgetsBelowOneStack(t *testing.T) {
+	now := time.Now()
+
+	sp := newSampler(Sampling{StacksPerSecond: 0.5}, nil)
+	if !sp.allowCapture(now, nil) || sp.allowCapture(now.Add(time.Second), nil) {
+		t.Errorf("0.5 stacks per second did not allow one stack and then limit")
+	}
+	if !sp.allowCapture(now.Add(2*time.Second), nil) {
+		t.Errorf("0.5 stacks per second did not allow a stack 2s later")
+	}
+
+	// Stacks larger than the bytes per second still fit in the burst
+	sp = newSampler(Sampling{BytesPerSecond: 100}, nil)
+	if !sp.allowBytes(now, 4000) {
+		t.Errorf("100 bytes per second did not allow a 4000 bytes stack")
+	}
+	for i := 0; i < 20; i++ {
+		sp.allowBytes(now, 4000)
+	}
+	if sp.allowBytes(now, 4000) {
+		t.Errorf("100 bytes per second allowed more than its burst")
+	}
+	if !sp.allowBytes(now.Add(40*time.Second), 4000) {
+		t.Errorf("100 bytes per second did not allow a 4000 bytes stack 40s later")
+	}
+}
+
+func TestStackToGraphSamplingStats(t *testing.T) {
+	skipUninstrumented(t)
+	s := &StackToGraph{}
+	if !s.allowCapture() {
+		t.Errorf("allowCapture() = false without sampling")
+	}
+
+	s.SetSampling(Sampling{StacksPerSecond: 1})
+	s.allowCapture()
+	s.allowCapture()
+	if got, want := s.SamplingStats(), (SamplingStats{BudgetExceeded: 1}); got != want {
+		t.Errorf("SamplingStats() = %+v; want %+v", got, want)
+	}
+}
@@ -0,0 +1,151 @@
+package stacktracetograph
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+)
+
+// schemaMigration is a versioned change to the constraints and indexes of
+// the graph. Migrations are applied in order and never modified once
+// released; changes to the model are added as new migrations.
+type schemaMigration struct {
+	version     int
+	description string
+	statements  []string
+}
+
+// schemaMigrationLabel is the label of the nodes recording applied migrations.
+const schemaMigrationLabel = "Stack2GraphMigration"
+
+var schemaMigrations = []schemaMigration{
+	{
+		version:     1,
+		description: "unique keys of functions and attached nodes",
+		statements: []string{
+			"CREATE CONSTRAINT stack2graph_function_key IF NOT EXISTS FOR (n:Function) REQUIRE (n.name, n.package) IS UNIQUE",
+			"CREATE CONSTRAINT stack2graph_error_key IF NOT EXISTS FOR (n:Error) REQUIRE (n.type, n.message) IS UNIQUE",
+			"CREATE CONSTRAINT stack2graph_log_event_key IF NOT EXISTS FOR (n:LogEvent) REQUIRE (n.message, n.level) IS UNIQUE",
+			"CREATE CONSTRAINT stack2graph_query_key IF NOT EXISTS FOR (n:Query) REQUIRE n.sql IS UNIQUE",
+			"CREATE CONSTRAINT stack2graph_external_endpoint_key IF NOT EXISTS FOR (n:ExternalEndpoint) REQUIRE (n.host, n.method, n.path) IS UNIQUE",
+			"CREATE CONSTRAINT stack2graph_migration_version IF NOT EXISTS FOR (n:" + schemaMigrationLabel + ") REQUIRE n.version IS UNIQUE",
+		},
+	},
+	{
+		version:     2,
+		description: "indexes for looking up functions by package and repository",
+		statements: []string{
+			"CREATE INDEX stack2graph_function_package IF NOT EXISTS FOR (n:Function) ON (n.package)",
+			"CREATE INDEX stack2graph_function_repository IF NOT EXISTS FOR (n:Function) ON (n.repository)",
+		},
+	},
+	{
+		version:     3,
+		description: "unique keys of goroutine groups",
+		statements: []string{
+			"CREATE CONSTRAINT stack2graph_goroutine_group_key IF NOT EXISTS FOR (n:GoroutineGroup) REQUIRE (n.signature, n.state) IS UNIQUE",
+		},
+	},
+	{
+		version:     4,
+		description: "unique keys of leak suspects",
+		statements: []string{
+			"CREATE CONSTRAINT stack2graph_leak_suspect_key IF NOT EXISTS FOR (n:LeakSuspect) REQUIRE (n.signature, n.state) IS UNIQUE",
+		},
+	},
+	{
+		version:     5,
+		description: "unique keys of block reasons",
+		statements: []string{
+			"CREATE CONSTRAINT stack2graph_block_reason_key IF NOT EXISTS FOR (n:BlockReason) REQUIRE n.reason IS UNIQUE",
+		},
+	},
+	{
+		version:     6,
+		description: "queries merged on the hash of their SQL, which can exceed the index key size",
+		statements: []string{
+			"DROP CONSTRAINT stack2graph_query_key IF EXISTS",
+			"CREATE CONSTRAINT stack2graph_query_hash IF NOT EXISTS FOR (n:Query) REQUIRE n.hash IS UNIQUE",
+		},
+	},
+	{
+		version:     7,
+		description: "unique IDs of the weighted reports applied",
+		statements: []string{
+			"CREATE CONSTRAINT stack2graph_applied_report_id IF NOT EXISTS FOR (n:" + appliedReportLabel + ") REQUIRE n.id IS UNIQUE",
+		},
+	},
+	{
+		version:     8,
+		description: "index for deleting the applied reports by age",
+		statements: []string{
+			"CREATE INDEX stack2graph_applied_report_applied_at IF NOT EXISTS FOR (n:" + appliedReportLabel + ") ON (n.appliedAt)",
+		},
+	},
+}
+
+// SetupSchema creates the constraints and indexes of the graph model by
+// applying the migrations that are not yet recorded in the database. It is
+// safe to call from several processes and on every startup.
+func (n *Neo4jSink) SetupSchema(ctx context.Context) error {
+	session := n.driver.NewSession(ctx, neo4j.SessionConfig{
+		DatabaseName: n.cfg.Database,
+		AccessMode:   neo4j.AccessModeWrite,
+	})
+	defer session.Close(ctx)
+
+	current, err := neo4j.ExecuteRead(ctx, session, func(tx neo4j.ManagedTransaction) (int64, error) {
+		result, err := tx.Run(ctx, "MATCH (m:"+schemaMigrationLabel+") RETURN coalesce(max(m.version), 0) AS version", nil)
+		if err != nil {
+			return 0, err
+		}
+		record, err := result.Single(ctx)
+		if err != nil {
+			return 0, err
+		}
+		version, _ := record.Values[0].(int64)
+		return version, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read schema version: %w", err)
+	}
+
+	for _, m := range pendingMigrations(current) {
+		// Schema changes cannot share a transaction with data writes
+		for _, statement := range m.statements {
+			if _, err := neo4j.ExecuteWrite(ctx, session, func(tx neo4j.ManagedTransaction) (any, error) {
+				_, err := tx.Run(ctx, statement, nil)
+				return nil, err
+			}); err != nil {
+				return fmt.Errorf("failed to apply schema migration %d: %w", m.version, err)
+			}
+		}
+
+		if _, err := neo4j.ExecuteWrite(ctx, session, func(tx neo4j.ManagedTransaction) (any, error) {
+			_, err := tx.Run(ctx, `
+				MERGE (m:`+schemaMigrationLabel+` {version: $version})
+				ON CREATE SET m.description = $description, m.appliedAt = datetime()
+			`, map[string]any{
+				"version":     m.version,
+				"description": m.description,
+			})
+			return nil, err
+		}); err != nil {
+			return fmt.Errorf("failed to record schema migration %d: %w", m.version, err)
+		}
+	}
+
+	return nil
+}
+
+// pendingMigrations returns the migrations newer than version.
+func pendingMigrations(version int64) []schemaMigration {
+	var pending []schemaMigration
+	for _, m := range schemaMigrations {
+		if int64(m.version) > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
@@ -0,0 +1,50 @@
+package stacktracetograph
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaMigrationsAreOrdered(t *testing.T) {
+	for i, m := range schemaMigrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d has version %d; want consecutive versions from 1", i, m.version)
+		}
+		if len(m.statements) == 0 || m.description == "" {
+			t.Errorf("migration %d has no statements or description", m.version)
+		}
+		for _, statement := range m.statements {
+			idempotent := strings.Contains(statement, "IF NOT EXISTS") ||
+				strings.HasPrefix(statement, "DROP ") && strings.HasSuffix(statement, " IF EXISTS")
+			if !idempotent {
+				t.Errorf("migration %d statement is not idempotent: %q", m.version, statement)
+			}
+		}
+	}
+}
+
+func TestSchemaCoversWrittenLabels(t *testing.T) {
+	var statements []string
+	for _, m := range schemaMigrations {
+		statements = append(statements, m.statements...)
+	}
+	all := strings.Join(statements, "\n")
+
+	for _, label := range []string{"Function", "Error", "LogEvent", "Query", "ExternalEndpoint", "GoroutineGroup", "LeakSuspect", "BlockReason"} {
+		if !strings.Contains(all, "FOR (n:"+label+") REQUIRE") {
+			t.Errorf("no constraint for label %s", label)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	if got := len(pendingMigrations(0)); got != len(schemaMigrations) {
+		t.Errorf("pendingMigrations(0) returned %d migrations; want all %d", got, len(schemaMigrations))
+	}
+	if got := pendingMigrations(int64(len(schemaMigrations))); len(got) != 0 {
+		t.Errorf("pendingMigrations(latest) returned %d migrations; want none", len(got))
+	}
+	if got := pendingMigrations(1); len(got) == 0 || got[0].version != 2 {
+		t.Errorf("pendingMigrations(1) does not start at version 2")
+	}
+}
@@ -0,0 +1,61 @@
+package stacktracetograph
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// Report is a parsed call stack together with the nodes attached to its frames.
+type Report struct {
+	Stack       []ParsedStackEntry `json:"stack"`
+	Attachments []Attachment       `json:"attachments,omitempty"`
+	Spawns      []Spawn            `json:"spawns,omitempty"` // goroutines started by functions, see Spawn
+	Labels      []string           `json:"labels,omitempty"` // extra labels of the Function nodes
+	// Weights are added to the CALLS relationships of the stack, and to the
+	// self_ properties of its top function, such as cpu_ns for a CPU profile.
+	Weights map[string]int64 `json:"weights,omitempty"`
+
+	Time      time.Time     `json:"time,omitzero"`       // when the stack was captured, zero if unknown
+	Goroutine int64         `json:"goroutine,omitempty"` // id of the goroutine of the stack, 0 if unknown
+	Duration  time.Duration `json:"duration,omitempty"`  // nanoseconds spent in the reported operation, if measured
+
+	// ID identifies a weighted report, so its weights are added once even
+	// when a retry or a replay writes it again. RetrySink and WALSink set it.
+	ID string `json:"id,omitempty"`
+}
+
+// weighted reports whether the report adds weights, which unlike the
+// merges of its nodes and relationships must not be applied twice.
+func (r Report) weighted() bool {
+	if len(r.Weights) > 0 {
+		return true
+	}
+	for _, a := range r.Attachments {
+		if len(a.Weights) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// withID returns the report with a new ID if it is weighted and has none.
+func (r Report) withID() Report {
+	if r.ID != "" || !r.weighted() {
+		return r
+	}
+	var b [16]byte
+	rand.Read(b[:])
+	r.ID = hex.EncodeToString(b[:])
+	return r
+}
+
+// Sink writes reports to a graph backend.
+type Sink interface {
+	// Write stores the functions of the report stack, the CALLS
+	// relationships between them and its attachments.
+	Write(ctx context.Context, report Report) error
+	// Close releases the resources of the sink.
+	Close() error
+}
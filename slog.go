@@ -0,0 +1,154 @@
+package stacktracetograph
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+)
+
+// SlogHandlerOptions selects the log records whose call stacks are reported.
+type SlogHandlerOptions struct {
+	// Level is the minimum level of reported records. If both Level and
+	// Attribute are unset, records at slog.LevelError and above are reported.
+	Level slog.Leveler
+	// Attribute reports records carrying an attribute with this key, below
+	// Level too if the wrapped handler is enabled for them.
+	Attribute string
+}
+
+// SlogHandler is a slog.Handler that reports the call stack of selected log
+// records, linking a LogEvent node to the function that logged it, before
+// passing every record on to the wrapped handler.
+type SlogHandler struct {
+	next   slog.Handler
+	s2g    *StackToGraph
+	opts   SlogHandlerOptions
+	attrs  []string // attributes added with WithAttrs, as key=value
+	groups string   // prefix of groups opened with WithGroup
+	marked bool     // an attribute added with WithAttrs matches opts.Attribute
+}
+
+// NewSlogHandler wraps next with a handler reporting log records to s.
+// If s is nil, the instance of the record context is used, see FromContext.
+func NewSlogHandler(next slog.Handler, s *StackToGraph, opts SlogHandlerOptions) *SlogHandler {
+	if opts.Level == nil && opts.Attribute == "" {
+		opts.Level = slog.LevelError
+	}
+	return &SlogHandler{
+		next: next,
+		s2g:  s,
+		opts: opts,
+	}
+}
+
+// Enabled reports whether the wrapped handler handles records at level, or
+// records at level are reported.
+func (h *SlogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.levelReported(level) || h.next.Enabled(ctx, level)
+}
+
+// Handle reports the record if it is selected and passes it on to the wrapped handler.
+func (h *SlogHandler) Handle(ctx context.Context, r slog.Record) error {
+	s := h.s2g
+	if s == nil {
+		s = FromContext(ctx)
+	}
+	if s != nil && h.shouldReport(r) && s.allowCapture("log/slog") {
+		stack := captureStackTrace()
+		// Errors are already logged by reportStack and must not prevent logging
+		_ = s.reportStack(ctx, stack, Attachment{
+			Label:        "LogEvent",
+			Relationship: "LOGS",
+			SkipPackages: []string{"log/slog"},
+			Key: map[string]interface{}{
+				"message": r.Message,
+				"level":   r.Level.String(),
+			},
+			Properties: map[string]interface{}{
+				"attrs": h.recordAttrs(r),
+			},
+		})
+	}
+
+	if !h.next.Enabled(ctx, r.Level) {
+		return nil
+	}
+	return h.next.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler whose records include attrs.
+func (h *SlogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.next = h.next.WithAttrs(attrs)
+	h2.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], flattenAttrs(h.groups, attrs)...)
+	for _, a := range attrs {
+		if h.opts.Attribute != "" && a.Key == h.opts.Attribute {
+			h2.marked = true
+		}
+	}
+	return &h2
+}
+
+// WithGroup returns a handler nesting the attributes of its records in group name.
+func (h *SlogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := *h
+	h2.next = h.next.WithGroup(name)
+	h2.groups = h.groups + name + "."
+	return &h2
+}
+
+func (h *SlogHandler) levelReported(level slog.Level) bool {
+	return h.opts.Level != nil && level >= h.opts.Level.Level()
+}
+
+// shouldReport reports whether the record is at or above the configured
+// level or carries the configured attribute.
+func (h *SlogHandler) shouldReport(r slog.Record) bool {
+	if h.levelReported(r.Level) || h.marked {
+		return true
+	}
+	if h.opts.Attribute == "" {
+		return false
+	}
+	found := false
+	r.Attrs(func(a slog.Attr) bool {
+		found = a.Key == h.opts.Attribute
+		return !found
+	})
+	return found
+}
+
+// recordAttrs returns the attributes of the handler and the record as key=value strings.
+func (h *SlogHandler) recordAttrs(r slog.Record) []string {
+	attrs := make([]string, 0, len(h.attrs)+r.NumAttrs())
+	attrs = append(attrs, h.attrs...)
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, flattenAttrs(h.groups, []slog.Attr{a})...)
+		return true
+	})
+	return attrs
+}
+
+// flattenAttrs renders attributes as key=value strings, joining group names with dots.
+func flattenAttrs(prefix string, attrs []slog.Attr) []string {
+	var flat []string
+	for _, a := range attrs {
+		value := a.Value.Resolve()
+		if value.Kind() == slog.KindGroup {
+			group := prefix
+			if a.Key != "" {
+				group += a.Key + "."
+			}
+			flat = append(flat, flattenAttrs(group, value.Group())...)
+			continue
+		}
+		if a.Key == "" {
+			continue
+		}
+		flat = append(flat, fmt.Sprintf("%s%s=%s", prefix, a.Key, value.String()))
+	}
+	return flat
+}
@@ -0,0 +1,120 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSlogHandlerShouldReport(t *testing.T) {
+	newRecord := func(level slog.Level, attrs ...slog.Attr) slog.Record {
+		r := slog.NewRecord(time.Time{}, level, "message", 0)
+		r.AddAttrs(attrs...)
+		return r
+	}
+	next := slog.NewTextHandler(&bytes.Buffer{}, nil)
+
+	tests := []struct {
+		name     string
+		opts     SlogHandlerOptions
+		record   slog.Record
+		expected bool
+	}{
+		{"default level below", SlogHandlerOptions{}, newRecord(slog.LevelWarn), false},
+		{"default level at", SlogHandlerOptions{}, newRecord(slog.LevelError), true},
+		{"configured level", SlogHandlerOptions{Level: slog.LevelWarn}, newRecord(slog.LevelWarn), true},
+		{"attribute only", SlogHandlerOptions{Attribute: "trace"}, newRecord(slog.LevelError), false},
+		{"attribute present", SlogHandlerOptions{Attribute: "trace"}, newRecord(slog.LevelDebug, slog.Bool("trace", true)), true},
+		{"attribute absent", SlogHandlerOptions{Level: slog.LevelError, Attribute: "trace"}, newRecord(slog.LevelInfo, slog.Int("user", 1)), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewSlogHandler(next, nil, test.opts)
+			if result := h.shouldReport(test.record); result != test.expected {
+				t.Errorf("shouldReport() = %v; want %v", result, test.expected)
+			}
+		})
+	}
+
+	// An attribute added with WithAttrs marks every record of the handler
+	h := NewSlogHandler(next, nil, SlogHandlerOptions{Attribute: "trace"}).WithAttrs([]slog.Attr{slog.Bool("trace", true)})
+	if !h.(*SlogHandler).shouldReport(newRecord(slog.LevelInfo)) {
+		t.Errorf("shouldReport() = false for a handler with the attribute; want true")
+	}
+}
+
+func TestSlogHandlerRecordAttrs(t *testing.T) {
+	h := NewSlogHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), nil, SlogHandlerOptions{}).
+		WithAttrs([]slog.Attr{slog.String("service", "api")}).
+		WithGroup("req")
+
+	r := slog.NewRecord(time.Time{}, slog.LevelInfo, "message", 0)
+	r.AddAttrs(slog.Int("id", 7), slog.Group("user", slog.String("name", "ana")))
+
+	expected := []string{"service=api", "req.id=7", "req.user.name=ana"}
+	if result := h.(*SlogHandler).recordAttrs(r); !reflect.DeepEqual(result, expected) {
+		t.Errorf("recordAttrs() = %q; want %q", result, expected)
+	}
+}
+
+func TestSlogHandlerForwardsRecords(t *testing.T) {
+	var buf bytes.Buffer
+	next := slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelInfo})
+	logger := slog.New(NewSlogHandler(next, nil, SlogHandlerOptions{Level: slog.LevelError + 1}))
+
+	logger.Debug("hidden")
+	logger.With("service", "api").Info("visible", "id", 7)
+
+	output := buf.String()
+	if strings.Contains(output, "hidden") {
+		t.Errorf("record below the wrapped handler level was forwarded: %q", output)
+	}
+	if !strings.Contains(output, "msg=visible service=api id=7") {
+		t.Errorf("record was not forwarded: %q", output)
+	}
+
+	if h := NewSlogHandler(next, nil, SlogHandlerOptions{}); !h.Enabled(context.Background(), slog.LevelError) {
+		t.Errorf("Enabled(LevelError) = false; want true")
+	}
+}
+
+func TestSlogHandlerEnabled(t *testing.T) {
+	next := slog.NewTextHandler(&bytes.Buffer{}, &slog.HandlerOptions{Level: slog.LevelInfo})
+	h := NewSlogHandler(next, nil, SlogHandlerOptions{Level: slog.LevelError, Attribute: "trace"})
+	for level, want := range map[slog.Level]bool{slog.LevelDebug: false, slog.LevelInfo: true, slog.LevelError: true} {
+		if got := h.Enabled(context.Background(), level); got != want {
+			t.Errorf("Enabled(%v) = %v; want %v", level, got, want)
+		}
+	}
+}
+
+func TestSlogHandlerReports(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+	logger := slog.New(NewSlogHandler(slog.NewTextHandler(&bytes.Buffer{}, nil), s, SlogHandlerOptions{}))
+
+	logger.Info("ignored")
+	logger.Error("payment failed", "order", 7)
+
+	reports := sink.Reports()
+	if len(reports) != 1 || len(reports[0].Attachments) != 1 {
+		t.Fatalf("sink received %+v; want one report with a LogEvent", reports)
+	}
+	report, a := reports[0], reports[0].Attachments[0]
+	if a.Label != "LogEvent" || a.Relationship != "LOGS" || a.Key["message"] != "payment failed" || a.Key["level"] != "ERROR" ||
+		!reflect.DeepEqual(a.Properties["attrs"], []string{"order=7"}) {
+		t.Errorf("attachment = %+v; want the ERROR record", a)
+	}
+	// The record is linked to the first frame outside log/slog and this
+	// package, the caller of the test function here
+	if a.Frame < 1 || report.Stack[a.Frame-1].Function != "TestSlogHandlerReports" || report.Stack[a.Frame].Package != "testing" {
+		t.Errorf("record linked to frame %d of %+v; want the caller of the test", a.Frame, report.Stack)
+	}
+}
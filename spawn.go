@@ -0,0 +1,96 @@
+package stacktracetograph
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Spawn is a goroutine started by a function, read from the "created by"
+// line ending the trace of the goroutine. It is written as a SPAWNS
+// relationship from Creator to Entry.
+type Spawn struct {
+	Creator ParsedStackEntry `json:"creator"` // function containing the go statement
+	Entry   ParsedStackEntry `json:"entry"`   // function the goroutine started with
+	// CreatorStack is the stack of the creating goroutine when it ran the go
+	// statement, starting with Creator. It is only known when the program
+	// runs with GODEBUG=tracebackancestors=N.
+	CreatorStack []ParsedStackEntry `json:"creatorStack,omitempty"`
+	// ParentGoroutine is the id of the creating goroutine, or 0 if unknown.
+	ParentGoroutine int64 `json:"parentGoroutine,omitempty"`
+}
+
+var (
+	createdByPattern   = regexp.MustCompile(`^created by (\S+)(?: in goroutine (\d+))?$`)
+	originatingPattern = regexp.MustCompile(`^\[originating from goroutine (\d+)\]:$`)
+)
+
+// parseGoroutineTrace parses the trace of one goroutine into its frames and
+// the chain of goroutines that created it, the direct creator first.
+// Ancestors beyond the direct creator are only listed with
+// GODEBUG=tracebackancestors=N.
+func parseGoroutineTrace(trace string) ([]ParsedStackEntry, []Spawn) {
+	var (
+		levels []strings.Builder // frames of the goroutine, then of each ancestor
+		spawns []Spawn
+	)
+	levels = append(levels, strings.Builder{})
+
+	lines := strings.Split(trace, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+
+		if m := createdByPattern.FindStringSubmatch(line); m != nil {
+			// The location of the go statement follows the "created by" line
+			creator := m[1] + "(...)\n"
+			if i+1 < len(lines) {
+				i++
+				creator += lines[i] + "\n"
+			}
+			parsed := parseStackTrace(creator)
+			frames := parseStackTrace(levels[len(levels)-1].String())
+			if len(parsed) == 0 || len(frames) == 0 {
+				continue
+			}
+			spawn := Spawn{Creator: parsed[0], Entry: frames[len(frames)-1]}
+			spawn.ParentGoroutine, _ = strconv.ParseInt(m[2], 10, 64)
+			spawns = append(spawns, spawn)
+			continue
+		}
+
+		if m := originatingPattern.FindStringSubmatch(line); m != nil {
+			levels = append(levels, strings.Builder{})
+			if len(spawns) == len(levels)-1 && spawns[len(spawns)-1].ParentGoroutine == 0 {
+				spawns[len(spawns)-1].ParentGoroutine, _ = strconv.ParseInt(m[1], 10, 64)
+			}
+			continue
+		}
+
+		levels[len(levels)-1].WriteString(lines[i] + "\n")
+	}
+
+	// Each ancestor trace is the stack of the creator of the level below it
+	for i := range spawns {
+		if i+1 < len(levels) {
+			spawns[i].CreatorStack = parseStackTrace(levels[i+1].String())
+		}
+	}
+
+	return parseStackTrace(levels[0].String()), spawns
+}
+
+// filterSpawns removes the spawns whose functions are rejected by the
+// configured filters, and the rejected frames of creator stacks.
+func (s *StackToGraph) filterSpawns(spawns []Spawn) []Spawn {
+	if len(s.filters) == 0 {
+		return spawns
+	}
+	kept := spawns[:0]
+	for _, spawn := range spawns {
+		if s.keepFrame(spawn.Creator) && s.keepFrame(spawn.Entry) {
+			spawn.CreatorStack = s.filterFrames(spawn.CreatorStack)
+			kept = append(kept, spawn)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,78 @@
+package stacktracetograph
+
+import (
+	"testing"
+)
+
+const ancestorsTrace = `goroutine 7 [running]:
+main.leaf(...)
+	/app/main.go:10
+created by main.middle in goroutine 6
+	/app/main.go:14 +0x59
+[originating from goroutine 6]:
+main.middle(...)
+	/app/main.go:14 +0x59
+created by main.start
+	/app/main.go:18 +0x76
+[originating from goroutine 1]:
+main.start(...)
+	/app/main.go:19 +0x76
+`
+
+func TestParseGoroutineTrace(t *testing.T) {
+	frames, spawns := parseGoroutineTrace(ancestorsTrace)
+	if len(frames) != 1 || frames[0].Function != "leaf" {
+		t.Fatalf("frames = %+v; want only main.leaf", frames)
+	}
+	if len(spawns) != 2 {
+		t.Fatalf("spawns = %+v; want 2", spawns)
+	}
+
+	tests := []struct {
+		creator, line, entry string
+		parent               int64
+		creatorStack         int
+	}{
+		{"middle", "14", "leaf", 6, 1},
+		{"start", "18", "middle", 1, 1},
+	}
+	for i, test := range tests {
+		spawn := spawns[i]
+		if spawn.Creator.Function != test.creator || spawn.Creator.Line != test.line || spawn.Entry.Function != test.entry {
+			t.Errorf("spawns[%d] = %s:%s SPAWNS %s; want %s:%s SPAWNS %s", i,
+				spawn.Creator.Function, spawn.Creator.Line, spawn.Entry.Function, test.creator, test.line, test.entry)
+		}
+		if spawn.ParentGoroutine != test.parent || len(spawn.CreatorStack) != test.creatorStack {
+			t.Errorf("spawns[%d] = parent %d with %d creator frames; want parent %d with %d",
+				i, spawn.ParentGoroutine, len(spawn.CreatorStack), test.parent, test.creatorStack)
+		}
+	}
+}
+
+func TestReportStacktraceSpawns(t *testing.T) {
+	skipUninstrumented(t)
+	sink := NewMemorySink()
+	s := NewStackToGraphWithSink(sink)
+	defer s.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.ReportStacktrace()
+	}()
+	<-done
+
+	reports := sink.Reports()
+	if len(reports) != 1 {
+		t.Fatalf("sink received %d reports; want 1", len(reports))
+	}
+	for _, frame := range reports[0].Stack {
+		if frame.Function == "TestReportStacktraceSpawns" && frame.OriginalName == "TestReportStacktraceSpawns" {
+			t.Errorf("the created by line was parsed as a frame: %+v", frame)
+		}
+	}
+	spawns := reports[0].Spawns
+	if len(spawns) != 1 || spawns[0].Creator.Function != "TestReportStacktraceSpawns" || spawns[0].ParentGoroutine == 0 {
+		t.Errorf("spawns = %+v; want the goroutine created by TestReportStacktraceSpawns", spawns)
+	}
+}
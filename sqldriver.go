@@ -0,0 +1,319 @@
+package stacktracetograph
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// WrapDriver returns a database/sql driver that reports the call stack of
+// every distinct query executed through d, linking the application function
+// that issued it to a Query node with an EXECUTES relationship.
+// If s is nil, the instance of the query context is used, see FromContext.
+func WrapDriver(d driver.Driver, s *StackToGraph) driver.Driver {
+	return &sqlDriver{driver: d, s2g: s}
+}
+
+// WrapConnector is like WrapDriver for connectors passed to sql.OpenDB.
+func WrapConnector(c driver.Connector, s *StackToGraph) driver.Connector {
+	return &sqlConnector{connector: c, driver: &sqlDriver{driver: c.Driver(), s2g: s}}
+}
+
+type sqlDriver struct {
+	driver driver.Driver
+	s2g    *StackToGraph
+}
+
+func (d *sqlDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{conn: conn, s2g: d.s2g}, nil
+}
+
+// OpenConnector uses the connector of the wrapped driver when it has one,
+// so its connection setup is kept.
+func (d *sqlDriver) OpenConnector(name string) (driver.Connector, error) {
+	opener, ok := d.driver.(driver.DriverContext)
+	if !ok {
+		return &sqlConnector{connector: dsnConnector{name: name, driver: d.driver}, driver: d}, nil
+	}
+	connector, err := opener.OpenConnector(name)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConnector{connector: connector, driver: d}, nil
+}
+
+// dsnConnector opens connections of drivers without connectors, like
+// database/sql does.
+type dsnConnector struct {
+	name   string
+	driver driver.Driver
+}
+
+func (c dsnConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.name)
+}
+
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+type sqlConnector struct {
+	connector driver.Connector
+	driver    *sqlDriver
+}
+
+func (c *sqlConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlConn{conn: conn, s2g: c.driver.s2g}, nil
+}
+
+func (c *sqlConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// sqlConn wraps a driver connection. It implements every optional
+// connection interface and falls back to the behaviour database/sql uses
+// when the wrapped connection does not.
+type sqlConn struct {
+	conn driver.Conn
+	s2g  *StackToGraph
+}
+
+// reportQuery reports the stack of the code executing query.
+func (c *sqlConn) reportQuery(ctx context.Context, query string) {
+	s := c.s2g
+	if s == nil {
+		s = FromContext(ctx)
+	}
+	if s == nil || !s.allowCapture("database/sql") {
+		return
+	}
+
+	stack := captureStackTrace()
+	normalized := normalizeQuery(query)
+	// Errors are already logged by reportStack and must not fail the query
+	_ = s.reportStack(ctx, stack, Attachment{
+		Label:        "Query",
+		Relationship: "EXECUTES",
+		SkipPackages: []string{"database/sql"},
+		Key: map[string]interface{}{
+			"hash": queryHash(normalized),
+		},
+		Properties: map[string]interface{}{
+			"sql": normalized,
+		},
+	})
+}
+
+func (c *sqlConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *sqlConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	preparer, ok := c.conn.(driver.ConnPrepareContext)
+	if !ok {
+		return c.Prepare(query)
+	}
+	stmt, err := preparer.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &sqlStmt{stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *sqlConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *sqlConn) Begin() (driver.Tx, error) {
+	return c.conn.Begin()
+}
+
+func (c *sqlConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if beginner, ok := c.conn.(driver.ConnBeginTx); ok {
+		return beginner.BeginTx(ctx, opts)
+	}
+
+	// Like database/sql, refuse options the connection cannot honour
+	if opts.Isolation != driver.IsolationLevel(sql.LevelDefault) {
+		return nil, errIsolationLevel
+	}
+	if opts.ReadOnly {
+		return nil, errReadOnly
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return c.conn.Begin()
+}
+
+func (c *sqlConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	result, err := execer.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.reportQuery(ctx, query)
+	}
+	return result, err
+}
+
+func (c *sqlConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	rows, err := queryer.QueryContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.reportQuery(ctx, query)
+	}
+	return rows, err
+}
+
+func (c *sqlConn) Ping(ctx context.Context) error {
+	if pinger, ok := c.conn.(driver.Pinger); ok {
+		return pinger.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) ResetSession(ctx context.Context) error {
+	if resetter, ok := c.conn.(driver.SessionResetter); ok {
+		return resetter.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *sqlConn) IsValid() bool {
+	if validator, ok := c.conn.(driver.Validator); ok {
+		return validator.IsValid()
+	}
+	return true
+}
+
+func (c *sqlConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := c.conn.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// sqlStmt wraps a prepared statement, reporting the stack of each execution.
+type sqlStmt struct {
+	stmt  driver.Stmt
+	conn  *sqlConn
+	query string
+}
+
+func (s *sqlStmt) Close() error {
+	return s.stmt.Close()
+}
+
+func (s *sqlStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+func (s *sqlStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.reportQuery(context.Background(), s.query)
+	return s.stmt.Exec(args)
+}
+
+func (s *sqlStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.reportQuery(context.Background(), s.query)
+	return s.stmt.Query(args)
+}
+
+func (s *sqlStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	execer, ok := s.stmt.(driver.StmtExecContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		s.conn.reportQuery(ctx, s.query)
+		return s.stmt.Exec(values)
+	}
+	s.conn.reportQuery(ctx, s.query)
+	return execer.ExecContext(ctx, args)
+}
+
+func (s *sqlStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	queryer, ok := s.stmt.(driver.StmtQueryContext)
+	if !ok {
+		values, err := namedValuesToValues(args)
+		if err != nil {
+			return nil, err
+		}
+		s.conn.reportQuery(ctx, s.query)
+		return s.stmt.Query(values)
+	}
+	s.conn.reportQuery(ctx, s.query)
+	return queryer.QueryContext(ctx, args)
+}
+
+func (s *sqlStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	if checker, ok := s.stmt.(driver.NamedValueChecker); ok {
+		return checker.CheckNamedValue(nv)
+	}
+	return s.conn.CheckNamedValue(nv)
+}
+
+// namedValuesToValues converts arguments for statements without context
+// support, which cannot take named parameters.
+func namedValuesToValues(named []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(named))
+	for i, nv := range named {
+		if nv.Name != "" {
+			return nil, errNamedParameters
+		}
+		values[i] = nv.Value
+	}
+	return values, nil
+}
+
+var (
+	errNamedParameters = errors.New("sql: driver does not support the use of Named Parameters")
+	errIsolationLevel  = errors.New("sql: driver does not support non-default isolation level")
+	errReadOnly        = errors.New("sql: driver does not support read-only transactions")
+)
+
+var (
+	sqlStringPattern     = regexp.MustCompile(`'(?:[^']|'')*'`)
+	sqlNumberPattern     = regexp.MustCompile(`([^\w$:.])-?\d+(?:\.\d+)?\b`)
+	sqlInListPattern     = regexp.MustCompile(`(?i)\bIN\s*\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	sqlWhitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// queryHash identifies a normalized query. Query nodes are merged on it
+// because long statements exceed the key size of Neo4j indexes.
+func queryHash(sql string) string {
+	sum := sha256.Sum256([]byte(sql))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeQuery collapses whitespace and replaces literal values with
+// placeholders so queries differing only by their values share a Query node.
+func normalizeQuery(query string) string {
+	query = sqlWhitespacePattern.ReplaceAllString(strings.TrimSpace(query), " ")
+	query = sqlStringPattern.ReplaceAllString(query, "?")
+	query = sqlNumberPattern.ReplaceAllString(query, "${1}?")
+	query = sqlInListPattern.ReplaceAllString(query, "IN (?)")
+	return query
+}
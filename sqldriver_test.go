@@ -0,0 +1,207 @@
+package stacktracetograph
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// fakeDriver records the statements it receives. Connections implement
+// ExecerContext only if direct is set, so prepared statements are used otherwise.
+type fakeDriver struct {
+	direct  bool
+	queries []string
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	conn := &fakeConn{driver: d}
+	if d.direct {
+		return &fakeDirectConn{conn}, nil
+	}
+	return conn, nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+type fakeDirectConn struct {
+	*fakeConn
+}
+
+func (c *fakeDirectConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	c.driver.queries = append(c.driver.queries, "exec: "+query)
+	return driver.RowsAffected(1), nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.conn.driver.queries = append(s.conn.driver.queries, "stmt exec: "+s.query)
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.conn.driver.queries = append(s.conn.driver.queries, "stmt query: "+s.query)
+	return &fakeRows{}, nil
+}
+
+type fakeRows struct{}
+
+func (r *fakeRows) Columns() []string              { return []string{"id"} }
+func (r *fakeRows) Close() error                   { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error { return io.EOF }
+
+func TestWrapDriver(t *testing.T) {
+	tests := []struct {
+		name     string
+		direct   bool
+		expected []string
+	}{
+		{"prepared statements", false, []string{"stmt exec: UPDATE users SET name = ? WHERE id = ?", "stmt query: SELECT id FROM users"}},
+		{"direct execution", true, []string{"exec: UPDATE users SET name = ? WHERE id = ?", "stmt query: SELECT id FROM users"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := &fakeDriver{direct: test.direct}
+			sql.Register("stack2graph-"+t.Name(), WrapDriver(fake, nil))
+
+			db, err := sql.Open("stack2graph-"+t.Name(), "")
+			if err != nil {
+				t.Fatalf("sql.Open: %v", err)
+			}
+			defer db.Close()
+
+			if _, err := db.Exec("UPDATE users SET name = ? WHERE id = ?", "ana", 1); err != nil {
+				t.Fatalf("Exec: %v", err)
+			}
+			rows, err := db.Query("SELECT id FROM users")
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			rows.Close()
+
+			if !reflect.DeepEqual(fake.queries, test.expected) {
+				t.Errorf("driver received %q; want %q", fake.queries, test.expected)
+			}
+		})
+	}
+}
+
+func TestWrapDriverReports(t *testing.T) {
+	skipUninstrumented(t)
+	for _, direct := range []bool{false, true} {
+		fake := &fakeDriver{direct: direct}
+		name := fmt.Sprintf("stack2graph-reports-%v", direct)
+		sql.Register(name, WrapDriver(fake, nil))
+		db, err := sql.Open(name, "")
+		if err != nil {
+			t.Fatalf("sql.Open: %v", err)
+		}
+		defer db.Close()
+
+		sink := NewMemorySink()
+		s := NewStackToGraphWithSink(sink)
+		defer s.Close()
+		if _, err := db.ExecContext(NewContext(context.Background(), s), "UPDATE users SET name = 'ana' WHERE id = 42"); err != nil {
+			t.Fatalf("Exec: %v", err)
+		}
+
+		reports := sink.Reports()
+		if len(reports) != 1 || len(reports[0].Attachments) != 1 {
+			t.Fatalf("direct %v: sink received %+v; want one report with a Query", direct, reports)
+		}
+		report, a := reports[0], reports[0].Attachments[0]
+		if a.Label != "Query" || a.Relationship != "EXECUTES" || a.Properties["sql"] != "UPDATE users SET name = ? WHERE id = ?" || a.Key["hash"] != queryHash("UPDATE users SET name = ? WHERE id = ?") {
+			t.Errorf("direct %v: attachment = %+v; want the normalized query", direct, a)
+		}
+		// The report is linked to the first frame outside database/sql and
+		// this package, the caller of the test function here
+		if a.Frame < 1 || report.Stack[a.Frame-1].Function != "TestWrapDriverReports" || report.Stack[a.Frame].Package != "testing" {
+			t.Errorf("direct %v: query linked to frame %d of %+v; want the caller of the test", direct, a.Frame, report.Stack)
+		}
+		for _, frame := range report.Stack[:a.Frame] {
+			if frame.Package != libraryPackage && frame.Package != "database/sql" {
+				t.Errorf("direct %v: frame %+v skipped", direct, frame)
+			}
+		}
+	}
+}
+
+// fakeContextDriver counts the connectors it opens.
+type fakeContextDriver struct {
+	*fakeDriver
+	connectors int
+}
+
+func (d *fakeContextDriver) OpenConnector(name string) (driver.Connector, error) {
+	d.connectors++
+	return dsnConnector{name: name, driver: d.fakeDriver}, nil
+}
+
+func TestWrapDriverTransactions(t *testing.T) {
+	fake := &fakeContextDriver{fakeDriver: &fakeDriver{}}
+	sql.Register("stack2graph-transactions", WrapDriver(fake, nil))
+	db, err := sql.Open("stack2graph-transactions", "")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+	if fake.connectors != 1 {
+		t.Errorf("wrapped driver opened %d connectors; want 1", fake.connectors)
+	}
+
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("BeginTx() = %v", err)
+	}
+	tx.Rollback()
+
+	// The fake connection does not implement BeginTx and cannot honour options
+	if _, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true}); err == nil || err.Error() != errReadOnly.Error() {
+		t.Errorf("read-only BeginTx() = %v; want %v", err, errReadOnly)
+	}
+	if _, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable}); err == nil || err.Error() != errIsolationLevel.Error() {
+		t.Errorf("serializable BeginTx() = %v; want %v", err, errIsolationLevel)
+	}
+}
+
+func TestNormalizeQuery(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"SELECT * FROM users WHERE id = 42", "SELECT * FROM users WHERE id = ?"},
+		{"SELECT *\n  FROM users\n WHERE name = 'O''Brien'", "SELECT * FROM users WHERE name = ?"},
+		{"SELECT * FROM users WHERE id IN (1, 2, 3)", "SELECT * FROM users WHERE id IN (?)"},
+		{"SELECT * FROM users WHERE id = $1 AND age > -3.5", "SELECT * FROM users WHERE id = $1 AND age > ?"},
+		{"SELECT * FROM table2 WHERE id = :id", "SELECT * FROM table2 WHERE id = :id"},
+	}
+
+	for _, test := range tests {
+		if result := normalizeQuery(test.input); result != test.expected {
+			t.Errorf("normalizeQuery(%q) = %q; want %q", test.input, result, test.expected)
+		}
+	}
+}
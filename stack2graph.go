@@ -1,166 +1,328 @@
 package stacktracetograph
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"reflect"
 	"regexp"
 	"runtime"
 	"strings"
 	"sync"
-
-	"github.com/neo4j/neo4j-go-driver/v5/neo4j"
+	"sync/atomic"
+	"time"
 )
 
-var GLOBAL_STACK_TO_GRAPH *StackToGraph
-
 type StackToGraph struct {
-	neo4jDriver neo4j.Driver
+	sink Sink
 	sync.Mutex
-	cacheReportedStacks map[string]bool
+	cache    *reportedCache
+	sampler  *sampler
+	filters  []FrameFilter
+	labels   []string
+	disabled atomic.Bool
+	metrics  metrics
+	// reportDuplicates writes stacks already reported, see WithDeduplication
+	reportDuplicates bool
+	logger           *slog.Logger // nil logs to slog.Default()
+
+	// Asynchronous writes, see WithAsync
+	queue   chan queuedReport
+	workers sync.WaitGroup
+	closed  bool
+
+	// Periodic goroutine snapshots, see WithGoroutineSnapshots
+	stopSnapshots chan struct{}
+	snapshotter   sync.WaitGroup
+	leaks         *LeakDetector
+}
+
+// queuedReport is a report waiting to be written by a background worker.
+type queuedReport struct {
+	ctx      context.Context
+	cacheKey string
+	report   Report
 }
 
+// asyncWriteTimeout bounds the writes of background workers, which are
+// detached from the deadline of the reporting code.
+const asyncWriteTimeout = 30 * time.Second
+
+// NewStackToGraph creates a StackToGraph writing to the Neo4j database at
+// uri. It does not verify that the database is reachable, writes fail
+// until it is; use New with WithNeo4j to verify it on startup.
 func NewStackToGraph(uri, username, password string) (*StackToGraph, error) {
-	driver, err := neo4j.NewDriver(uri, neo4j.BasicAuth(username, password, ""))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Neo4j driver: %w", err)
-	}
+	return New(WithNeo4j(Neo4jConfig{
+		URI:        uri,
+		Username:   username,
+		Password:   password,
+		SkipVerify: true,
+	}))
+}
 
-	return &StackToGraph{
-		neo4jDriver: driver,
-	}, nil
+// NewStackToGraphWithSink creates a StackToGraph writing reports to sink.
+func NewStackToGraphWithSink(sink Sink) *StackToGraph {
+	s, _ := New(WithSink(sink))
+	return s
 }
 
+// SetupGlobal makes s the default instance.
+//
+// Deprecated: Use SetDefault.
 func (s *StackToGraph) SetupGlobal() {
-	GLOBAL_STACK_TO_GRAPH = s
+	SetDefault(s)
+}
+
+// SetEnabled turns reporting on or off at runtime. While disabled, reporting
+// returns immediately without capturing a stack.
+func (s *StackToGraph) SetEnabled(enabled bool) {
+	s.disabled.Store(!enabled)
+}
+
+// Enabled reports whether reporting is turned on.
+func (s *StackToGraph) Enabled() bool {
+	return !s.disabled.Load()
 }
 
 func (s *StackToGraph) ReportStacktrace() error {
+	return s.ReportStacktraceContext(context.Background())
+}
+
+// ReportStacktraceContext reports the stack of the caller, writing it with
+// ctx so the write is bounded by its deadline.
+func (s *StackToGraph) ReportStacktraceContext(ctx context.Context) error {
+	// Skip the report if it is sampled out or rate limited
+	if !s.allowCapture() {
+		return nil
+	}
+
 	// Capture the stack trace
 	stack := captureStackTrace()
 
+	return s.reportStack(ctx, stack)
+}
+
+// StartSpan captures the stack of the caller and returns a function that
+// reports it with the time elapsed since, when the operation ends. Spans are
+// shown as slices by WriteChromeTrace:
+//
+//	defer s2g.StartSpan(ctx)()
+func (s *StackToGraph) StartSpan(ctx context.Context) func() error {
+	if !s.allowCapture() {
+		return func() error { return nil }
+	}
+	stack := captureStackTrace()
+	started := time.Now()
+	return func() error {
+		return s.reportSpan(ctx, stack, time.Since(started))
+	}
+}
+
+// reportStack parses and reports a captured stack trace, together with any
+// attachments, skipping combinations that were already reported.
+func (s *StackToGraph) reportStack(ctx context.Context, stack string, attachments ...Attachment) error {
+	return s.reportSpan(ctx, stack, 0, attachments...)
+}
+
+// reportSpan is like reportStack for a stack that took duration, ending now.
+func (s *StackToGraph) reportSpan(ctx context.Context, stack string, duration time.Duration, attachments ...Attachment) error {
+	captured := time.Now()
+
+	// Parse the stack trace to extract function calls
+	frames, spawns := parseGoroutineTrace(stack)
+	parsedStack := s.filterFrames(frames)
+	spawns = s.filterSpawns(spawns)
+	s.metrics.stacksCaptured.Add(1)
+
+	// The raw trace differs between goroutines and calls by its header and
+	// arguments, the cache remembers the path and what is attached to it
+	cacheKey := stackSignature(parsedStack)
+	for _, spawn := range spawns {
+		cacheKey += "\n" + stackSignature([]ParsedStackEntry{spawn.Creator, spawn.Entry})
+	}
+	for _, a := range attachments {
+		cacheKey += "\n" + a.cacheKey()
+	}
+
 	// Lock the cache to avoid race
 	s.Lock()
-	if s.cacheReportedStacks == nil {
-		s.cacheReportedStacks = make(map[string]bool)
+	if s.cache == nil {
+		s.cache = newReportedCache(0)
 	}
-	if _, ok := s.cacheReportedStacks[stack]; ok {
+	if s.cache.contains(cacheKey) && !s.reportDuplicates {
 		s.Unlock()
 		// Skip reporting the same stack trace
+		s.metrics.cacheHits.Add(1)
 		return nil
 	}
 	s.Unlock()
 
-	// Parse the stack trace to extract function calls
-	parsedStack := parseStackTrace(stack)
+	if !s.allowBytes(len(stack)) {
+		return nil
+	}
+
+	s.metrics.framesPerStack.observe(framesPerStackBounds, float64(len(parsedStack)))
 
-	// Report the stack trace to Neo4j
-	err := s.reportStackTraceToNeo4j(parsedStack)
+	// Link each attachment to the function that produced it
+	for i := range attachments {
+		attachments[i].Frame = originFrame(parsedStack, attachments[i].SkipPackages...)
+	}
+
+	report := Report{
+		Stack:       parsedStack,
+		Attachments: attachments,
+		Spawns:      spawns,
+		Labels:      s.labels,
+		Time:        captured,
+		Goroutine:   traceGoroutineID(stack),
+		Duration:    duration,
+	}
+	return s.submit(ctx, cacheKey, report)
+}
+
+// submit queues the report if writes are asynchronous, or writes it. Reports
+// with an empty cacheKey, such as goroutine snapshots, are not remembered.
+func (s *StackToGraph) submit(ctx context.Context, cacheKey string, report Report) error {
+	if s.queue != nil {
+		s.enqueue(ctx, cacheKey, report)
+		return nil
+	}
+	return s.write(ctx, cacheKey, report)
+}
+
+// write writes the report to the sink and remembers it was reported.
+func (s *StackToGraph) write(ctx context.Context, cacheKey string, report Report) error {
+	started := time.Now()
+	err := s.sink.Write(ctx, report)
+	s.metrics.observeWrite(started, err)
+	if errors.Is(err, ErrCircuitOpen) {
+		// The backend is known to be down, the stack is reported again later
+		loggerOrDefault(s.logger).LogAttrs(ctx, slog.LevelDebug, "stack2graph: backend unavailable, skipping report", s.logAttrs(cacheKey, report)...)
+		return nil
+	}
 	if err != nil {
-		log.Printf("Error reporting stack trace to Neo4j: %v\n", err)
+		attrs := append(s.logAttrs(cacheKey, report), slog.Any("error", err))
+		loggerOrDefault(s.logger).LogAttrs(ctx, slog.LevelError, "stack2graph: failed to write report", attrs...)
 		return err
 	}
-	s.Lock()
-	s.cacheReportedStacks[stack] = true
-	s.Unlock()
+	if cacheKey != "" {
+		s.Lock()
+		s.cache.add(cacheKey, report.Stack)
+		s.Unlock()
+	}
 
 	return nil
 }
 
-func (s *StackToGraph) reportStackTraceToNeo4j(stackTraceData []ParsedStackEntry) error {
-	// Create a new session
-	session := s.neo4jDriver.NewSession(neo4j.SessionConfig{DatabaseName: "neo4j"})
-	defer session.Close()
-
-	// Execute a write transaction
-	_, err := session.WriteTransaction(func(tx neo4j.Transaction) (interface{}, error) {
-
-		var previousNodeID interface{}
-
-		// Reverse the stack to represent the top-down call flow
-		for i := len(stackTraceData) - 1; i >= 0; i-- {
-			frame := stackTraceData[i]
-
-			// Merge node for each function call to avoid duplicates
-			result, err := tx.Run(`
-	        	MERGE (f:Function {name: $name, package: $package})
-		    SET f.file = $file, f.line = $line, f.function = $function, f.receiver = $receiver, f.packageName = $packageName, f.repository = $repository, f.repositoryOrganization = $repositoryOrganization, f.repositoryName = $repositoryName, f.folder = $folder, f.folderName = $folderName
-		    RETURN id(f) AS nodeID
-
-			`, map[string]interface{}{
-				"name":                   frame.OriginalName,
-				"receiver":               frame.Receiver,
-				"function":               frame.Function,
-				"file":                   frame.File,
-				"line":                   frame.Line,
-				"package":                frame.Package,
-				"packageName":            frame.PackageName,
-				"repository":             frame.Repository,
-				"repositoryOrganization": frame.RepositoryOrganization,
-				"repositoryName":         frame.RepositoryName,
-				"folder":                 frame.Folder,
-				"folderName":             frame.FolderName,
-			})
-			if err != nil {
-				return nil, err
-			}
-
-			record, err := result.Single()
-			if err != nil {
-				return nil, err
-			}
-			currentNodeID := record.Values[0]
-
-			// Create "CALLS" relationship from the previous node to the current node
-			if previousNodeID != nil {
-				_, err = tx.Run(`
-					MATCH (caller), (callee)
-					WHERE id(caller) = $callerID AND id(callee) = $calleeID
-					MERGE (caller)-[:CALLS]->(callee)
-				`, map[string]interface{}{
-					"callerID": previousNodeID,
-					"calleeID": currentNodeID,
-				})
-				if err != nil {
-					return nil, err
-				}
-			}
+// filterFrames removes the frames rejected by the configured filters.
+func (s *StackToGraph) filterFrames(stack []ParsedStackEntry) []ParsedStackEntry {
+	if len(s.filters) == 0 {
+		return stack
+	}
+	kept := stack[:0]
+	for _, frame := range stack {
+		if s.keepFrame(frame) {
+			kept = append(kept, frame)
+		}
+	}
+	return kept
+}
 
-			previousNodeID = currentNodeID
+// keepFrame reports whether the frame passes all the configured filters.
+func (s *StackToGraph) keepFrame(frame ParsedStackEntry) bool {
+	for _, filter := range s.filters {
+		if !filter(frame) {
+			return false
 		}
+	}
+	return true
+}
 
-		return nil, nil
-	})
+// startWorkers starts the goroutines writing queued reports.
+func (s *StackToGraph) startWorkers(queueSize, workers int) {
+	if workers <= 0 {
+		workers = 1
+	}
+	s.queue = make(chan queuedReport, queueSize)
+	for i := 0; i < workers; i++ {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			for q := range s.queue {
+				ctx, cancel := context.WithTimeout(q.ctx, asyncWriteTimeout)
+				s.write(ctx, q.cacheKey, q.report)
+				cancel()
+			}
+		}()
+	}
+}
 
-	if err != nil {
-		return fmt.Errorf("failed to execute write transaction: %w", err)
+// enqueue queues the report for a background worker, dropping it if the queue is full.
+func (s *StackToGraph) enqueue(ctx context.Context, cacheKey string, report Report) {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.queue <- queuedReport{ctx: context.WithoutCancel(ctx), cacheKey: cacheKey, report: report}:
+	default:
+		s.metrics.dropped.Add(1)
+		loggerOrDefault(s.logger).LogAttrs(ctx, slog.LevelWarn, "stack2graph: async queue full, dropping report", s.logAttrs(cacheKey, report)...)
 	}
+}
 
-	return nil
+// DroppedReports returns the number of reports dropped because the queue
+// of asynchronous writes was full.
+func (s *StackToGraph) DroppedReports() int64 {
+	return s.metrics.dropped.Load()
 }
 
-// Close the Neo4j driver when the application exits
+// Close writes the queued reports and closes the sink when the application exits
 func (s *StackToGraph) Close() {
-	if s.neo4jDriver != nil {
-		s.neo4jDriver.Close()
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return
 	}
-}
+	s.closed = true
+	if s.stopSnapshots != nil {
+		close(s.stopSnapshots)
+	}
+	s.Unlock()
+
+	// Stop producing snapshots before closing the queue they are written to
+	s.snapshotter.Wait()
+	s.Lock()
+	if s.queue != nil {
+		close(s.queue)
+	}
+	s.Unlock()
 
-// ReportStacktrace encapsulates capturing, parsing, and reporting the stack trace to Neo4j.
-func ReportStacktrace() error {
-	if GLOBAL_STACK_TO_GRAPH == nil {
-		return fmt.Errorf("global StackToGraph instance is not set. Call SetupGlobal before using ReportStacktrace.")
+	s.workers.Wait()
+	if s.sink != nil {
+		s.sink.Close()
 	}
-	return GLOBAL_STACK_TO_GRAPH.ReportStacktrace()
 }
 
 // captureStackTrace captures the current call stack as a string.
+// maxStackBytes is the size of the buffer stacks are captured in, 64KB,
+// which is usually sufficient.
+const maxStackBytes = 1 << 16
+
 func captureStackTrace() string {
-	// Adjust buffer size if needed (1<<16 is 64KB, which is usually sufficient)
-	buf := make([]byte, 1<<16)
+	buf := make([]byte, maxStackBytes)
 	stackSize := runtime.Stack(buf, false)
 	return string(buf[:stackSize])
 }
 
+// ParseStackTrace parses a stack trace in the format of runtime.Stack into
+// its frames, top first.
+func ParseStackTrace(stackTrace string) []ParsedStackEntry {
+	return parseStackTrace(stackTrace)
+}
+
 // parseStackTrace extracts function names, file paths, and line numbers from the stack trace.
 // It also cleans up function names by removing arguments.
 func parseStackTrace(stackTrace string) []ParsedStackEntry {
@@ -235,6 +397,10 @@ func ParseRepository(s string) (string, string, string) {
 	return "", "", ""
 }
 
+// anonFuncPattern matches the names of closures like func1, func2 and the
+// parts of func6.1.
+var anonFuncPattern = regexp.MustCompile(`^(func)?\d+$`)
+
 // ParseReceiver extracts the receiver from a function name.
 // It returns the original function name, cleaned function name and the receiver.
 func ParseReceiver(s string) (string, string, string) {
@@ -242,28 +408,26 @@ func ParseReceiver(s string) (string, string, string) {
 		return "", "", ""
 	}
 
-	parts := strings.Split(s, ".")
-	if len(parts) == 0 {
-		return s, s, ""
+	// Type parameters are elided as [...], whose dots do not separate names
+	parts := strings.Split(strings.ReplaceAll(s, "[...]", "\x00"), ".")
+	for i, part := range parts {
+		parts[i] = strings.ReplaceAll(part, "\x00", "[...]")
 	}
 
-	// Regular expression to match anonymous functions like func1, func2, func6.1
-	anonFuncPattern := regexp.MustCompile(`^func\d+(\.\d+)*$`)
-
-	// Start from the end and find the first non-anonymous function name
+	// Start from the end and find the first name that is not a closure, like
+	// func1, func2 or the 1 of func6.1
 	functionName := ""
 	var receiver string
 	for i := len(parts) - 1; i >= 0; i-- {
 		part := parts[i]
 		if anonFuncPattern.MatchString(part) {
 			continue
-		} else {
-			functionName = part
-			if i > 0 {
-				receiver = parts[i-1]
-			}
-			break
 		}
+		functionName = part
+		if i > 0 {
+			receiver = parts[i-1]
+		}
+		break
 	}
 
 	// If functionName is still empty, it means all parts were anonymous functions
@@ -282,9 +446,9 @@ func ReplacePointerNotation(input string) string {
 	// Define the regex pattern to match "(*TypeName)"
 	// Explanation:
 	// \\(\\*    : Matches the literal "(*"
-	// ([A-Za-z0-9_]+) : Captures one or more alphanumeric characters or underscores (TypeName)
+	// ([A-Za-z0-9_]+(?:\\[\\.\\.\\.\\])?) : Captures the TypeName, with its elided type parameters [...]
 	// \\)       : Matches the literal ")"
-	pattern := `\(\*([A-Za-z0-9_]+)\)`
+	pattern := `\(\*([A-Za-z0-9_]+(?:\[\.\.\.\])?)\)`
 
 	// Compile the regex
 	re := regexp.MustCompile(pattern)
@@ -354,16 +518,47 @@ func parsePackageName(s string) string {
 }
 
 type ParsedStackEntry struct {
-	Receiver               string
-	Function               string
-	File                   string // /path/to/file.go
-	Folder                 string // /path/to
-	FolderName             string // to
-	Line                   string
-	Package                string // github.com/x/y/z
-	PackageName            string // z
-	OriginalName           string
-	Repository             string // github.com/x/y
-	RepositoryOrganization string // x
-	RepositoryName         string // y
+	Receiver               string `json:"receiver,omitempty"`
+	Function               string `json:"function"`
+	File                   string `json:"file"`       // /path/to/file.go
+	Folder                 string `json:"folder"`     // /path/to
+	FolderName             string `json:"folderName"` // to
+	Line                   string `json:"line"`
+	Package                string `json:"package"`     // github.com/x/y/z
+	PackageName            string `json:"packageName"` // z
+	OriginalName           string `json:"originalName"`
+	Repository             string `json:"repository,omitempty"`             // github.com/x/y
+	RepositoryOrganization string `json:"repositoryOrganization,omitempty"` // x
+	RepositoryName         string `json:"repositoryName,omitempty"`         // y
+}
+
+// libraryPackage is the import path of this package, used to skip its own frames.
+var libraryPackage = reflect.TypeOf(StackToGraph{}).PkgPath()
+
+// Attachment is a node linked to one frame of a reported stack, such as the
+// error created by that function.
+type Attachment struct {
+	Label        string                 `json:"label"`                  // Error
+	Relationship string                 `json:"relationship"`           // ERROR_ORIGIN
+	Frame        int                    `json:"frame"`                  // index in the parsed stack of the function the node is linked from
+	SkipPackages []string               `json:"skipPackages,omitempty"` // packages skipped, besides this one, when resolving Frame
+	Key          map[string]interface{} `json:"key,omitempty"`          // properties the node is merged on
+	Properties   map[string]interface{} `json:"properties,omitempty"`   // properties set on every report
+	Weights      map[string]int64       `json:"weights,omitempty"`      // added to the relationship, such as blocked_ns
+}
+
+// cacheKey identifies the attachment for the reported stacks cache.
+func (a Attachment) cacheKey() string {
+	return fmt.Sprintf("%s:%s:%v", a.Relationship, a.Label, a.Key)
+}
+
+// originFrame returns the index of the first frame that belongs neither to
+// this package nor to any of the given packages, or -1 if there is none.
+func originFrame(stack []ParsedStackEntry, skipPackages ...string) int {
+	for i, frame := range stack {
+		if !skipPackage(frame.Package, skipPackages) {
+			return i
+		}
+	}
+	return -1
 }
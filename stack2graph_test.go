@@ -266,7 +266,7 @@ func TestParsePackageName(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		result := ParsePackageName(tc.input)
+		result, _ := ParsePackageName(tc.input)
 		if result != tc.expected {
 			t.Errorf("ParsePackageName(%q) = %q; expected %q", tc.input, result, tc.expected)
 		}
@@ -332,11 +332,12 @@ func TestParseReceiver(t *testing.T) {
 		{"(*Person).SayHello", "SayHello", "(*Person)"},
 		{"(*ServeMux).ServeHTTP", "ServeHTTP", "(*ServeMux)"},
 		{"HandlerFunc.ServeHTTP", "ServeHTTP", "HandlerFunc"},
+		{"HandlerFunc.ServeHTTP.func1", "ServeHTTP", "HandlerFunc"},
 		{"ApiServer.(*Middleware).Wrap.func3", "Wrap", "(*Middleware)"},
 		{"NewZivoAPIHandler.func1", "NewZivoAPIHandler", ""},
 		{"(*Handler).ServeHTTP", "ServeHTTP", "(*Handler)"},
 		{"NewUnaryHandler[...].func2", "NewUnaryHandler[...]", ""},
-		{"ApiServer.NewInterceptor.func2.1", "NewInterceptor", ""},
+		{"ApiServer.NewInterceptor.func2.1", "NewInterceptor", "ApiServer"},
 		{"NewUnaryHandler[...].func1", "NewUnaryHandler[...]", ""},
 		{"(*Handler).SendSms", "SendSms", "(*Handler)"},
 		{"(*SmsProviderFactory).BuildSmsProvider", "BuildSmsProvider", "(*SmsProviderFactory)"},
@@ -347,8 +348,9 @@ func TestParseReceiver(t *testing.T) {
 
 	for _, test := range tests {
 		t.Run(test.input, func(t *testing.T) {
-			fn, recv := ParseReceiver(test.input)
-			if fn != test.expectedFunc || recv != test.expectedRecv {
+			// Receivers are returned without their pointer notation
+			_, fn, recv := ParseReceiver(test.input)
+			if fn != test.expectedFunc || recv != ReplacePointerNotation(test.expectedRecv) {
 				t.Errorf("ParseReceiver(%q) = (%q, %q); want (%q, %q)", test.input, fn, recv, test.expectedFunc, test.expectedRecv)
 			}
 		})
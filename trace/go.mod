@@ -0,0 +1,17 @@
+module github.com/wricardo/stacktrace-to-graph/trace
+
+go 1.25.0
+
+require (
+	github.com/wricardo/stacktrace-to-graph v0.0.0-20261018192720-69149f68b261
+	golang.org/x/exp v0.0.0-20260611194520-c48552f49976
+)
+
+require (
+	github.com/google/pprof v0.0.0-20250403155104-27863c87afa6 // indirect
+	github.com/neo4j/neo4j-go-driver/v5 v5.24.0 // indirect
+)
+
+// Builds in this repository use the enclosing module, consumers of this
+// module get the version required above.
+replace github.com/wricardo/stacktrace-to-graph => ../
@@ -0,0 +1,231 @@
+// Package trace imports runtime/trace execution traces into a stack2graph
+// sink. It is a separate module because reading the traces of current Go
+// releases needs a recent golang.org/x/exp/trace and Go version.
+package trace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	stacktracetograph "github.com/wricardo/stacktrace-to-graph"
+	"golang.org/x/exp/trace"
+)
+
+// ImportOptions configures Import.
+type ImportOptions struct {
+	// Labels are added to the Function nodes written.
+	Labels []string
+	// Filter drops frames from the imported stacks, like WithFilter.
+	Filter stacktracetograph.FrameFilter
+}
+
+// blockingSkipPackages are the packages skipped when linking a blocked
+// goroutine to the function that blocked.
+var blockingSkipPackages = []string{"runtime", "sync", "time", "internal/poll"}
+
+// ImportFile imports the execution trace stored at path. See Import.
+func ImportFile(ctx context.Context, sink stacktracetograph.Sink, path string, opts ImportOptions) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return Import(ctx, sink, f, opts)
+}
+
+// Import reads an execution trace written by runtime/trace and writes
+// to sink the goroutines created, as SPAWNS relationships from the stack of
+// the creating goroutine, and the times goroutines blocked, as BLOCKS_ON
+// relationships from the blocked function to a BlockReason node such as
+// "chan receive". BLOCKS_ON relationships accumulate the number of blocks
+// and the time blocked in blocks and blocked_ns. It returns the number of
+// reports written.
+func Import(ctx context.Context, sink stacktracetograph.Sink, r io.Reader, opts ImportOptions) (int, error) {
+	reader, err := trace.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trace: %w", err)
+	}
+
+	type block struct {
+		start  trace.Time
+		stack  trace.Stack
+		reason string
+	}
+	var (
+		spawns  = newTraceAggregator()
+		blocks  = newTraceAggregator()
+		waiting = make(map[trace.GoID]block)
+		last    trace.Time
+	)
+	endBlock := func(id trace.GoID, end trace.Time) {
+		b, ok := waiting[id]
+		if !ok {
+			return
+		}
+		delete(waiting, id)
+		blocks.add(b.stack, b.reason, int64(end.Sub(b.start)))
+	}
+
+	for {
+		ev, err := reader.ReadEvent()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read trace: %w", err)
+		}
+		last = ev.Time()
+		if ev.Kind() != trace.EventStateTransition {
+			continue
+		}
+		st := ev.StateTransition()
+		if st.Resource.Kind != trace.ResourceGoroutine {
+			continue
+		}
+
+		id := st.Resource.Goroutine()
+		from, to := st.Goroutine()
+		switch {
+		case from == trace.GoNotExist && to == trace.GoRunnable:
+			// The event stack is the creator's, the transition stack the new goroutine's
+			if ev.Stack() != trace.NoStack && st.Stack != trace.NoStack {
+				spawns.addSpawn(ev.Stack(), st.Stack)
+			}
+		case to == trace.GoWaiting && ev.Stack() != trace.NoStack:
+			// Goroutines block themselves, the event stack is the blocked one
+			waiting[id] = block{start: ev.Time(), stack: ev.Stack(), reason: st.Reason}
+		case from == trace.GoWaiting:
+			endBlock(id, ev.Time())
+		}
+	}
+	// Goroutines still blocked at the end of the trace are blocked until then
+	for id := range waiting {
+		endBlock(id, last)
+	}
+
+	var reports []stacktracetograph.Report
+	for _, a := range spawns.entries {
+		creatorStack := traceStack(a.stack, opts.Filter)
+		entry := traceStack(a.spawned, opts.Filter)
+		if len(creatorStack) == 0 || len(entry) == 0 {
+			continue
+		}
+		reports = append(reports, stacktracetograph.Report{
+			Stack: creatorStack,
+			Spawns: []stacktracetograph.Spawn{{
+				Creator:      creatorStack[0],
+				CreatorStack: creatorStack,
+				// The starting stack of a goroutine is its entry function
+				Entry: entry[len(entry)-1],
+			}},
+			Labels: opts.Labels,
+		})
+	}
+	for _, a := range blocks.entries {
+		stack := traceStack(a.stack, opts.Filter)
+		frame := -1
+		for i, f := range stack {
+			if !skipTracePackage(f.Package) {
+				frame = i
+				break
+			}
+		}
+		if frame < 0 {
+			// Runtime goroutines
+			continue
+		}
+		reports = append(reports, stacktracetograph.Report{
+			Stack: stack,
+			Attachments: []stacktracetograph.Attachment{{
+				Label:        "BlockReason",
+				Relationship: "BLOCKS_ON",
+				Frame:        frame,
+				Key:          map[string]interface{}{"reason": a.reason},
+				Weights:      map[string]int64{"blocks": a.count, "blocked_ns": a.total},
+			}},
+			Labels: opts.Labels,
+		})
+	}
+
+	for i, report := range reports {
+		if err := sink.Write(ctx, report); err != nil {
+			return i, err
+		}
+	}
+	return len(reports), nil
+}
+
+// skipTracePackage reports whether pkg is skipped when linking a blocked
+// goroutine to the function that blocked.
+func skipTracePackage(pkg string) bool {
+	for _, skip := range blockingSkipPackages {
+		if pkg == skip || strings.HasPrefix(pkg, skip+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// traceAggregator merges the events of a trace sharing stacks.
+type traceAggregator struct {
+	index   map[traceKey]*traceEntry
+	entries []*traceEntry
+}
+
+type traceKey struct {
+	stack   trace.Stack
+	spawned trace.Stack
+	reason  string
+}
+
+// traceEntry counts the blocks of a stack and sums the time blocked; spawns
+// are only deduplicated.
+type traceEntry struct {
+	traceKey
+	count int64
+	total int64
+}
+
+func newTraceAggregator() *traceAggregator {
+	return &traceAggregator{index: make(map[traceKey]*traceEntry)}
+}
+
+func (a *traceAggregator) entry(key traceKey) *traceEntry {
+	e, ok := a.index[key]
+	if !ok {
+		e = &traceEntry{traceKey: key}
+		a.index[key] = e
+		a.entries = append(a.entries, e)
+	}
+	return e
+}
+
+func (a *traceAggregator) add(stack trace.Stack, reason string, value int64) {
+	e := a.entry(traceKey{stack: stack, reason: reason})
+	e.count++
+	e.total += value
+}
+
+func (a *traceAggregator) addSpawn(creator, spawned trace.Stack) {
+	a.entry(traceKey{stack: creator, spawned: spawned})
+}
+
+// traceStack returns the frames of a trace stack, top first.
+func traceStack(stack trace.Stack, filter stacktracetograph.FrameFilter) []stacktracetograph.ParsedStackEntry {
+	// Render the frames like runtime.Stack so they are parsed the same way
+	var b strings.Builder
+	for frame := range stack.Frames() {
+		fmt.Fprintf(&b, "%s(...)\n\t%s:%d\n", frame.Func, frame.File, frame.Line)
+	}
+
+	var kept []stacktracetograph.ParsedStackEntry
+	for _, frame := range stacktracetograph.ParseStackTrace(b.String()) {
+		if filter == nil || filter(frame) {
+			kept = append(kept, frame)
+		}
+	}
+	return kept
+}
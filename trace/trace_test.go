@@ -0,0 +1,66 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	rtrace "runtime/trace"
+	"testing"
+	"time"
+
+	stacktracetograph "github.com/wricardo/stacktrace-to-graph"
+)
+
+// traceWorker blocks until it receives from ch.
+func traceWorker(ch chan struct{}, done chan struct{}) {
+	<-ch
+	close(done)
+}
+
+func TestImport(t *testing.T) {
+	var buf bytes.Buffer
+	if err := rtrace.Start(&buf); err != nil {
+		t.Skipf("cannot start tracing: %v", err)
+	}
+	ch, done := make(chan struct{}), make(chan struct{})
+	go traceWorker(ch, done)
+	time.Sleep(5 * time.Millisecond)
+	close(ch)
+	<-done
+	rtrace.Stop()
+
+	sink := stacktracetograph.NewMemorySink()
+	written, err := Import(context.Background(), sink, &buf, ImportOptions{Labels: []string{"Traced"}})
+	if err != nil {
+		t.Fatalf("Import() = %v", err)
+	}
+	if written != len(sink.Reports()) {
+		t.Errorf("Import() = %d; want the %d reports written", written, len(sink.Reports()))
+	}
+
+	var spawned, blocked bool
+	for _, report := range sink.Reports() {
+		for _, spawn := range report.Spawns {
+			if spawn.Entry.Function == "traceWorker" && spawn.Creator.Function == "TestImport" {
+				spawned = true
+			}
+		}
+		for _, a := range report.Attachments {
+			if a.Relationship != "BLOCKS_ON" || report.Stack[a.Frame].Function != "traceWorker" {
+				continue
+			}
+			blocked = true
+			if a.Key["reason"] != "chan receive" || a.Weights["blocks"] != 1 || a.Weights["blocked_ns"] < int64(time.Millisecond) {
+				t.Errorf("BLOCKS_ON attachment = %+v; want one chan receive of a few milliseconds", a)
+			}
+		}
+		if len(report.Labels) != 1 || report.Labels[0] != "Traced" {
+			t.Errorf("report labels = %v; want Traced", report.Labels)
+		}
+	}
+	if !spawned {
+		t.Errorf("no SPAWNS from TestImport to traceWorker")
+	}
+	if !blocked {
+		t.Errorf("no BLOCKS_ON from traceWorker")
+	}
+}
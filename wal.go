@@ -0,0 +1,469 @@
+package stacktracetograph
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WALOptions configures a WALSink. Zero values select the defaults.
+type WALOptions struct {
+	// SegmentBytes is the size after which a new segment file is started. Default 4 MiB.
+	SegmentBytes int64
+	// MaxBytes caps the size of all segments. The oldest segments are
+	// dropped to make room for new reports. Default 256 MiB.
+	MaxBytes int64
+	// ReplayInterval is how often replaying buffered reports to the
+	// backend is attempted. Default 5 seconds.
+	ReplayInterval time.Duration
+	// Logger receives failed writes and replays. Default slog.Default().
+	Logger *slog.Logger
+}
+
+// WALStats describes the state of a WALSink.
+type WALStats struct {
+	Segments     int   // segment files waiting to be replayed
+	PendingBytes int64 // size of the segment files
+	Dropped      int64 // reports dropped because of MaxBytes
+	Corrupted    int64 // unreadable records skipped while replaying
+}
+
+// WALSink writes reports to a backend sink and, while the backend is
+// unavailable, appends them to a log of segment files in a local directory.
+// Buffered reports are replayed to the backend in order once it recovers.
+// A report can be written to the backend twice if the process stops while
+// replaying. Writes to the graph are idempotent merges, and weighted reports
+// get an ID with which Neo4jSink skips reports it already applied.
+type WALSink struct {
+	dir     string
+	backend Sink
+	opts    WALOptions
+
+	mu           sync.Mutex
+	segments     []walSegment
+	active       *os.File // last segment, open for appending
+	replayOffset int64    // offset in the first segment of the next record to replay
+	nextSeq      uint64
+	dropped      int64
+	corrupted    int64
+
+	replayMu sync.Mutex // serializes replays
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type walSegment struct {
+	seq  uint64
+	path string
+	size int64
+}
+
+const walSegmentExt = ".wal"
+
+// walMagic starts every record, so reading can resynchronize after a corrupted record.
+var walMagic = []byte("S2GW")
+
+// NewWALSink opens or creates the segment log in dir and starts replaying
+// any reports it already contains to backend.
+func NewWALSink(dir string, backend Sink, opts WALOptions) (*WALSink, error) {
+	if opts.SegmentBytes <= 0 {
+		opts.SegmentBytes = 4 << 20
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 256 << 20
+	}
+	if opts.ReplayInterval <= 0 {
+		opts.ReplayInterval = 5 * time.Second
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	segments, err := readWALSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WALSink{
+		dir:      dir,
+		backend:  backend,
+		opts:     opts,
+		segments: segments,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(segments) > 0 {
+		w.nextSeq = segments[len(segments)-1].seq + 1
+	}
+
+	go w.replayLoop()
+
+	return w, nil
+}
+
+// readWALSegments lists the segment files of dir in order.
+func readWALSegments(dir string) ([]walSegment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL directory: %w", err)
+	}
+
+	var segments []walSegment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, walSegmentExt) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat WAL segment: %w", err)
+		}
+		segments = append(segments, walSegment{seq: seq, path: filepath.Join(dir, name), size: info.Size()})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].seq < segments[j].seq })
+
+	return segments, nil
+}
+
+// Write writes the report to the backend, or appends it to the log if the
+// backend fails or older reports are still waiting to be replayed.
+func (w *WALSink) Write(ctx context.Context, report Report) error {
+	report = report.withID()
+
+	w.mu.Lock()
+	pending := len(w.segments) > 0
+	w.mu.Unlock()
+
+	if !pending {
+		err := w.backend.Write(ctx, report)
+		if err == nil {
+			return nil
+		}
+		loggerOrDefault(w.opts.Logger).LogAttrs(ctx, slog.LevelWarn, "stack2graph: failed to write report, buffering it in the WAL",
+			slog.String("backend", fmt.Sprintf("%T", w.backend)), slog.Any("error", err))
+	}
+
+	return w.append(report)
+}
+
+// append adds the report to the last segment.
+func (w *WALSink) append(report Report) error {
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	record := encodeWALRecord(payload)
+	size := int64(len(record))
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Drop the oldest segments to stay within MaxBytes
+	for w.pendingBytes()+size > w.opts.MaxBytes && len(w.segments) > 0 {
+		if len(w.segments) == 1 && w.active != nil {
+			w.dropped++
+			return fmt.Errorf("WAL is full, dropping report")
+		}
+		if err := w.dropOldest(); err != nil {
+			return err
+		}
+	}
+
+	if w.active == nil || w.segments[len(w.segments)-1].size+size > w.opts.SegmentBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := w.active.Write(record); err != nil {
+		return fmt.Errorf("failed to append to WAL: %w", err)
+	}
+	w.segments[len(w.segments)-1].size += size
+
+	return nil
+}
+
+func (w *WALSink) pendingBytes() int64 {
+	var total int64
+	for _, seg := range w.segments {
+		total += seg.size
+	}
+	return total
+}
+
+// rotate closes the active segment and starts a new one. w.mu must be held.
+func (w *WALSink) rotate() error {
+	if err := w.seal(); err != nil {
+		return err
+	}
+
+	seg := walSegment{seq: w.nextSeq, path: filepath.Join(w.dir, fmt.Sprintf("%020d%s", w.nextSeq, walSegmentExt))}
+	f, err := os.OpenFile(seg.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	w.nextSeq++
+	w.active = f
+	w.segments = append(w.segments, seg)
+
+	return nil
+}
+
+// seal closes the active segment, if any. w.mu must be held.
+func (w *WALSink) seal() error {
+	if w.active == nil {
+		return nil
+	}
+	err := w.active.Close()
+	w.active = nil
+	if err != nil {
+		return fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	return nil
+}
+
+// dropOldest removes the first segment, counting its unreplayed records as
+// dropped. w.mu must be held.
+func (w *WALSink) dropOldest() error {
+	seg := w.segments[0]
+	if len(w.segments) == 1 {
+		if err := w.seal(); err != nil {
+			return err
+		}
+	}
+	if r, err := readWALSegment(seg.path, w.replayOffset); err == nil {
+		for {
+			if _, err := r.next(); err != nil {
+				break
+			}
+			w.dropped++
+		}
+	}
+	w.segments = w.segments[1:]
+	w.replayOffset = 0
+	if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove WAL segment: %w", err)
+	}
+	return nil
+}
+
+func (w *WALSink) replayLoop() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.opts.ReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Replay(context.Background()); err != nil {
+			loggerOrDefault(w.opts.Logger).LogAttrs(context.Background(), slog.LevelError, "stack2graph: failed to replay WAL",
+				slog.String("backend", fmt.Sprintf("%T", w.backend)), slog.String("dir", w.dir), slog.Any("error", err))
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Replay writes the buffered reports to the backend in order, removing
+// segments once all their reports are written. It stops at the first
+// backend error.
+func (w *WALSink) Replay(ctx context.Context) error {
+	w.replayMu.Lock()
+	defer w.replayMu.Unlock()
+
+	for {
+		w.mu.Lock()
+		if len(w.segments) == 0 {
+			w.mu.Unlock()
+			return nil
+		}
+		// New reports go to a new segment while this one is replayed
+		if len(w.segments) == 1 {
+			if err := w.seal(); err != nil {
+				w.mu.Unlock()
+				return err
+			}
+		}
+		seg := w.segments[0]
+		offset := w.replayOffset
+		w.mu.Unlock()
+
+		if err := w.replaySegment(ctx, seg, offset); err != nil {
+			return err
+		}
+
+		w.mu.Lock()
+		// The segment may have been dropped while it was replayed
+		if len(w.segments) > 0 && w.segments[0].seq == seg.seq {
+			w.segments = w.segments[1:]
+			w.replayOffset = 0
+			if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				w.mu.Unlock()
+				return fmt.Errorf("failed to remove WAL segment: %w", err)
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// replaySegment writes the records of seg from offset to the backend.
+func (w *WALSink) replaySegment(ctx context.Context, seg walSegment, offset int64) error {
+	r, err := readWALSegment(seg.path, offset)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read WAL segment: %w", err)
+	}
+
+	for {
+		payload, err := r.next()
+		w.mu.Lock()
+		w.corrupted += r.corrupted
+		w.mu.Unlock()
+		r.corrupted = 0
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var report Report
+		if err := unmarshalNumbers(payload, &report); err != nil {
+			w.mu.Lock()
+			w.corrupted++
+			w.mu.Unlock()
+		} else {
+			report.restoreNumbers()
+			if err := w.backend.Write(ctx, report); err != nil {
+				return fmt.Errorf("failed to replay report: %w", err)
+			}
+		}
+
+		w.mu.Lock()
+		if len(w.segments) > 0 && w.segments[0].seq == seg.seq {
+			w.replayOffset = r.offset
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Stats returns the state of the log.
+func (w *WALSink) Stats() WALStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return WALStats{
+		Segments:     len(w.segments),
+		PendingBytes: w.pendingBytes(),
+		Dropped:      w.dropped,
+		Corrupted:    w.corrupted,
+	}
+}
+
+// Close stops replaying, closes the log and the backend. Buffered reports
+// are kept on disk and replayed by the next WALSink opened on the directory.
+func (w *WALSink) Close() error {
+	close(w.stop)
+	<-w.done
+
+	w.mu.Lock()
+	err := w.seal()
+	w.mu.Unlock()
+
+	if berr := w.backend.Close(); err == nil {
+		err = berr
+	}
+	return err
+}
+
+// encodeWALRecord frames payload as magic, length, CRC-32 and payload.
+func encodeWALRecord(payload []byte) []byte {
+	record := make([]byte, 0, len(walMagic)+8+len(payload))
+	record = append(record, walMagic...)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(payload)))
+	record = binary.BigEndian.AppendUint32(record, crc32.ChecksumIEEE(payload))
+	return append(record, payload...)
+}
+
+// walReader reads the records of a segment, skipping corrupted records by
+// scanning for the next magic marker.
+type walReader struct {
+	data      []byte
+	offset    int64 // offset of the next unread byte
+	corrupted int64
+}
+
+// readWALSegment reads the segment at path, starting at offset.
+func readWALSegment(path string, offset int64) (*walReader, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if offset > int64(len(data)) {
+		offset = 0
+	}
+	return &walReader{data: data, offset: offset}, nil
+}
+
+// next returns the payload of the next valid record, or io.EOF at the end
+// of the segment. A record truncated at the end of the segment is skipped.
+func (r *walReader) next() ([]byte, error) {
+	headerLen := int64(len(walMagic) + 8)
+	for {
+		rest := r.data[r.offset:]
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		if int64(len(rest)) < headerLen || !bytes.HasPrefix(rest, walMagic) {
+			r.corrupted++
+			r.resync(1)
+			continue
+		}
+
+		length := int64(binary.BigEndian.Uint32(rest[len(walMagic):]))
+		checksum := binary.BigEndian.Uint32(rest[len(walMagic)+4:])
+		end := headerLen + length
+		if end > int64(len(rest)) || crc32.ChecksumIEEE(rest[headerLen:end]) != checksum {
+			r.corrupted++
+			r.resync(int64(len(walMagic)))
+			continue
+		}
+
+		r.offset += end
+		return rest[headerLen:end], nil
+	}
+}
+
+// resync skips at least skip bytes, up to the next magic marker or the end of the segment.
+func (r *walReader) resync(skip int64) {
+	start := r.offset + skip
+	if start > int64(len(r.data)) {
+		start = int64(len(r.data))
+	}
+	i := bytes.Index(r.data[start:], walMagic)
+	if i < 0 {
+		r.offset = int64(len(r.data))
+		return
+	}
+	r.offset = start + int64(i)
+}
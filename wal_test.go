@@ -0,0 +1,247 @@
+package stacktracetograph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink stores the function names of the reports it receives and
+// fails while down is set.
+type recordingSink struct {
+	sync.Mutex
+	down    bool
+	written []string
+}
+
+func (r *recordingSink) Write(ctx context.Context, report Report) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.down {
+		return errors.New("backend unavailable")
+	}
+	r.written = append(r.written, report.Stack[0].Function)
+	return nil
+}
+
+func (r *recordingSink) Close() error { return nil }
+
+func (r *recordingSink) setDown(down bool) {
+	r.Lock()
+	defer r.Unlock()
+	r.down = down
+}
+
+func (r *recordingSink) functions() []string {
+	r.Lock()
+	defer r.Unlock()
+	return append([]string(nil), r.written...)
+}
+
+func walTestReport(function string) Report {
+	return Report{Stack: []ParsedStackEntry{{Function: function, Package: "main"}}}
+}
+
+func TestWALSinkBuffersWhileBackendIsDown(t *testing.T) {
+	ctx := context.Background()
+	backend := &recordingSink{down: true}
+	w, err := NewWALSink(t.TempDir(), backend, WALOptions{SegmentBytes: 200, ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+
+	for _, fn := range []string{"a", "b", "c", "d"} {
+		if err := w.Write(ctx, walTestReport(fn)); err != nil {
+			t.Fatalf("Write(%s): %v", fn, err)
+		}
+	}
+	if stats := w.Stats(); stats.Segments < 2 {
+		t.Errorf("Stats().Segments = %d; want the reports spread over several segments", stats.Segments)
+	}
+	if err := w.Replay(ctx); err == nil {
+		t.Errorf("Replay succeeded while the backend is down")
+	}
+
+	backend.setDown(false)
+	// Reports written while older ones are buffered keep their order
+	if err := w.Write(ctx, walTestReport("e")); err != nil {
+		t.Fatalf("Write(e): %v", err)
+	}
+	if err := w.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if got, want := backend.functions(), []string{"a", "b", "c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backend received %q; want %q", got, want)
+	}
+	if stats := w.Stats(); stats != (WALStats{}) {
+		t.Errorf("Stats() = %+v after replaying; want an empty log", stats)
+	}
+
+	if err := w.Write(ctx, walTestReport("f")); err != nil {
+		t.Fatalf("Write(f): %v", err)
+	}
+	if got := backend.functions(); got[len(got)-1] != "f" || w.Stats().Segments != 0 {
+		t.Errorf("report was not written directly to the recovered backend")
+	}
+}
+
+func TestWALSinkReplaysAfterRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	backend := &recordingSink{down: true}
+
+	w, err := NewWALSink(dir, backend, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	w.Write(ctx, walTestReport("a"))
+	w.Write(ctx, walTestReport("b"))
+	w.Close()
+
+	backend.setDown(false)
+	w, err = NewWALSink(dir, backend, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+	if err := w.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if got, want := backend.functions(), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backend received %q; want %q", got, want)
+	}
+}
+
+func TestWALSinkReplaysAttachmentNumbers(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	w, err := NewWALSink(dir, &recordingSink{down: true}, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	report := walTestReport("a")
+	report.Attachments = []Attachment{{
+		Label:      "Query",
+		Key:        map[string]any{"id": int64(42)},
+		Properties: map[string]any{"count": int64(3), "ratio": 0.5},
+	}}
+	w.Write(ctx, report)
+	w.Close()
+
+	memory := NewMemorySink()
+	w, err = NewWALSink(dir, memory, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+	if err := w.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	reports := memory.Reports()
+	if len(reports) != 1 || !reflect.DeepEqual(reports[0].Attachments, report.Attachments) {
+		t.Errorf("replayed %+v; want attachments %+v", reports, report.Attachments)
+	}
+}
+
+func TestWALSinkKeepsReportID(t *testing.T) {
+	ctx := context.Background()
+	backend := &idSink{flakySink: flakySink{err: errors.New("backend unavailable"), failures: 1}}
+	w, err := NewWALSink(t.TempDir(), backend, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+
+	report := walTestReport("a")
+	report.Attachments = []Attachment{{Label: "BlockReason", Weights: map[string]int64{"blocks": 1}}}
+	if err := w.Write(ctx, report); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	// The failed write may have been applied, the replay must be recognizable
+	if len(backend.ids) != 2 || backend.ids[0] == "" || backend.ids[1] != backend.ids[0] {
+		t.Errorf("writes had IDs %q; want the replay to keep the ID of the weighted report", backend.ids)
+	}
+}
+
+func TestWALSinkSkipsCorruptedRecords(t *testing.T) {
+	dir := t.TempDir()
+	record := func(fn string) []byte {
+		payload, _ := json.Marshal(walTestReport(fn))
+		return encodeWALRecord(payload)
+	}
+
+	var data []byte
+	data = append(data, record("a")...)
+	data = append(data, "garbage"...)
+	data = append(data, record("b")...)
+	bad := record("c")
+	bad[len(bad)-2] ^= 0xff // checksum mismatch
+	data = append(data, bad...)
+	data = append(data, record("d")...)
+	data = append(data, record("e")[:10]...) // truncated by a crash
+	if err := os.WriteFile(filepath.Join(dir, "00000000000000000001.wal"), data, 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	backend := &recordingSink{}
+	w, err := NewWALSink(dir, backend, WALOptions{ReplayInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+	if err := w.Replay(context.Background()); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+
+	if got, want := backend.functions(), []string{"a", "b", "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backend received %q; want %q", got, want)
+	}
+	if got := w.Stats().Corrupted; got != 3 {
+		t.Errorf("Stats().Corrupted = %d; want 3", got)
+	}
+}
+
+func TestWALSinkMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	backend := &recordingSink{down: true}
+
+	payload, _ := json.Marshal(walTestReport("a"))
+	recordSize := int64(len(encodeWALRecord(payload)))
+
+	w, err := NewWALSink(t.TempDir(), backend, WALOptions{
+		SegmentBytes:   recordSize,
+		MaxBytes:       3 * recordSize,
+		ReplayInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("NewWALSink: %v", err)
+	}
+	defer w.Close()
+
+	for _, fn := range []string{"a", "b", "c", "d", "e"} {
+		w.Write(ctx, walTestReport(fn))
+	}
+	if stats := w.Stats(); stats.Dropped != 2 || stats.PendingBytes != 3*recordSize {
+		t.Errorf("Stats() = %+v; want 2 dropped reports and %d pending bytes", stats, 3*recordSize)
+	}
+
+	backend.setDown(false)
+	if err := w.Replay(ctx); err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if got, want := backend.functions(), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backend received %q; want %q", got, want)
+	}
+}